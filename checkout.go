@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"sportlife/types"
+)
+
+// Subscription type recorded for payments made through /checkout
+const cartSubscriptionType = "Cart"
+
+// One priced line of a cart payment
+type LineItem struct {
+	ItemID    string      `json:"itemId"`
+	Name      string      `json:"name"`
+	UnitPrice types.Money `json:"unitPrice"`
+	Quantity  int         `json:"quantity"`
+	Total     types.Money `json:"total"`
+}
+
+// Customer and card details plus the cart being bought
+type CartCheckoutRequest struct {
+	TransactionID string `json:"transactionId,omitempty"`
+	CartID        int64  `json:"cartId"`
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	Phone         string `json:"phone"`
+	CardNumber    string `json:"cardNumber"`
+	// The items the customer confirmed. Their prices are ignored.
+	CartItems []types.CartItem `json:"cartItems"`
+}
+
+// Pay for a stored cart. Totals are recomputed from the prices in cart_items and whatever
+// the client believes the items cost is ignored.
+func handleCheckout(w http.ResponseWriter, r *http.Request) {
+	var req CartCheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	var items []LineItem
+	var amount types.Money
+	var fields []types.FieldError
+	err := traceStage(r.Context(), "payment.validate", func(ctx context.Context) error {
+		cart, err := loadCart(ctx, db, strconv.FormatInt(req.CartID, 10))
+		if err != nil {
+			return err
+		}
+		items, fields = priceCartItems(cart, req.CartItems)
+		amount, err = cartTotal(items)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid checkout", types.FieldError{Field: "cartId", Message: "is not a known cart"})
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading cart", "cart_id", req.CartID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading cart")
+		return
+	}
+
+	data := PaymentData{
+		TransactionID: req.TransactionID,
+		Email:         req.Email,
+		Name:          req.Name,
+		Phone:         req.Phone,
+		CardNumber:    req.CardNumber,
+		Amount:        amount,
+		Items:         items,
+	}
+	if len(fields) == 0 {
+		fields = validatePaymentData(data)
+	} else {
+		// The amount error would only repeat the item errors
+		for _, f := range validatePaymentData(data) {
+			if f.Field != "amount" {
+				fields = append(fields, f)
+			}
+		}
+	}
+	if len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid checkout", fields...)
+		return
+	}
+
+	acceptPayment(w, r, data, cartSubscriptionType)
+}
+
+// Price the cart's items from cart_items. The items the customer confirmed must be exactly the
+// cart's, so a cart changed after the customer saw it is never charged.
+func priceCartItems(cart *types.Cart, confirmed []types.CartItem) ([]LineItem, []types.FieldError) {
+	if len(confirmed) == 0 {
+		return nil, []types.FieldError{{Field: "cartItems", Message: "must contain at least one item"}}
+	}
+
+	stored := make(map[string]types.CartItem, len(cart.Items))
+	for _, item := range cart.Items {
+		stored[item.ID] = item
+	}
+	var fields []types.FieldError
+	items := make([]LineItem, 0, len(confirmed))
+	for i, item := range confirmed {
+		cartItem, ok := stored[item.ID]
+		if !ok {
+			fields = append(fields, types.FieldError{Field: fmt.Sprintf("cartItems[%d].id", i), Message: "is not in the cart"})
+			continue
+		}
+		delete(stored, item.ID)
+		if item.Quantity != cartItem.Quantity {
+			fields = append(fields, types.FieldError{Field: fmt.Sprintf("cartItems[%d].quantity", i), Message: "does not match the cart"})
+			continue
+		}
+		items = append(items, LineItem{
+			ItemID:    cartItem.ID,
+			Name:      cartItem.Name,
+			UnitPrice: cartItem.Price,
+			Quantity:  cartItem.Quantity,
+			Total:     cartItem.Price.Mul(int64(cartItem.Quantity)),
+		})
+	}
+	if len(stored) > 0 {
+		fields = append(fields, types.FieldError{Field: "cartItems", Message: "is missing items that are in the cart"})
+	}
+	return items, fields
+}
+
+func cartTotal(items []LineItem) (types.Money, error) {
+	if len(items) == 0 {
+		return types.Money{}, nil
+	}
+	total := items[0].Total
+	for _, item := range items[1:] {
+		var err error
+		if total, err = total.Add(item.Total); err != nil {
+			return types.Money{}, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,465 @@
+// Package client is a typed Go client for the SportLife payment service.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"sportlife/types"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	DefaultBaseURL    = "http://localhost:8081"
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 200 * time.Millisecond
+)
+
+// Options configure a Client. Zero values fall back to the defaults above.
+type Options struct {
+	BaseURL    string
+	Timeout    time.Duration
+	MaxRetries int
+	Backoff    time.Duration
+	// Token is sent as a bearer token on every request
+	Token string
+	// TokenSource, when set, is called before every request and takes precedence over Token
+	TokenSource func(ctx context.Context) (string, error)
+	HTTPClient  *http.Client
+}
+
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	maxRetries  int
+	backoff     time.Duration
+	token       string
+	tokenSource func(ctx context.Context) (string, error)
+}
+
+func New(opts Options) *Client {
+	c := &Client{
+		baseURL:     strings.TrimRight(opts.BaseURL, "/"),
+		httpClient:  opts.HTTPClient,
+		maxRetries:  opts.MaxRetries,
+		backoff:     opts.Backoff,
+		token:       opts.Token,
+		tokenSource: opts.TokenSource,
+	}
+	if c.baseURL == "" {
+		c.baseURL = DefaultBaseURL
+	}
+	if c.httpClient == nil {
+		timeout := opts.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		// otelhttp propagates the caller's trace context to the payment service
+		c.httpClient = &http.Client{Timeout: timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = DefaultMaxRetries
+	}
+	if c.backoff == 0 {
+		c.backoff = DefaultBackoff
+	}
+	return c
+}
+
+type requestIDKey struct{}
+
+// WithRequestID attaches a request ID that is forwarded as X-Request-ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+type forwardedForKey struct{}
+
+// WithForwardedFor attaches the IP of the customer a call is made for, sent as X-Forwarded-For so
+// the service rate limits and screens the customer rather than the caller. The service only
+// believes it from proxies it trusts.
+func WithForwardedFor(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, forwardedForKey{}, ip)
+}
+
+// InitPayment starts a payment for a subscription
+func (c *Client) InitPayment(ctx context.Context, req InitPaymentRequest) (*InitPaymentResponse, error) {
+	var resp InitPaymentResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/init-payment", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ProcessPayment charges the customer and sends the receipt
+func (c *Client) ProcessPayment(ctx context.Context, data PaymentData) (*ProcessPaymentResponse, error) {
+	var resp ProcessPaymentResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/process-payment", data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Checkout queues payment for a stored cart; the service prices the items itself and keeps them as line items
+func (c *Client) Checkout(ctx context.Context, req CheckoutRequest) (*ProcessPaymentResponse, error) {
+	var resp ProcessPaymentResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/checkout", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetPayment fetches a stored payment by transaction ID; the token must belong to an admin
+func (c *Client) GetPayment(ctx context.Context, transactionID string) (*Payment, error) {
+	var resp Payment
+	if err := c.do(ctx, http.MethodGet, "/v1/payments/"+url.PathEscape(transactionID), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetPaymentStatus fetches the processing status of a payment, given the status token it was
+// accepted with
+func (c *Client) GetPaymentStatus(ctx context.Context, transactionID, statusToken string) (*PaymentStatus, error) {
+	var resp PaymentStatus
+	path := "/v1/payments/" + url.PathEscape(transactionID) + "/status?token=" + url.QueryEscape(statusToken)
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// WaitForPayment polls the payment status every interval until it finishes, stalls on a
+// 3-D Secure challenge or a fraud review, or ctx is done
+func (c *Client) WaitForPayment(ctx context.Context, transactionID, statusToken string, interval time.Duration) (*PaymentStatus, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status, err := c.GetPaymentStatus(ctx, transactionID, statusToken)
+		if err != nil {
+			return nil, err
+		}
+		if status.Finished() || status.AwaitingCardholder() || status.UnderReview() {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// MyPayments lists the payments of the customer the token belongs to, newest first. A zero
+// limit uses the service's default page size.
+func (c *Client) MyPayments(ctx context.Context, limit, offset int) (*CustomerPayments, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+	path := "/v1/me/payments"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var resp CustomerPayments
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PaymentMethods lists the cards the customer the token belongs to has saved, the default first
+func (c *Client) PaymentMethods(ctx context.Context) ([]PaymentMethod, error) {
+	var resp struct {
+		PaymentMethods []PaymentMethod `json:"paymentMethods"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/me/payment-methods", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.PaymentMethods, nil
+}
+
+// DeletePaymentMethod forgets a saved card
+func (c *Client) DeletePaymentMethod(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/me/payment-methods/"+strconv.FormatInt(id, 10), nil, nil)
+}
+
+// SetDefaultPaymentMethod makes a saved card the one renewals are charged to and returns the
+// updated list
+func (c *Client) SetDefaultPaymentMethod(ctx context.Context, id int64) ([]PaymentMethod, error) {
+	var resp struct {
+		PaymentMethods []PaymentMethod `json:"paymentMethods"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/me/payment-methods/"+strconv.FormatInt(id, 10)+"/default", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.PaymentMethods, nil
+}
+
+// Refund returns part or all of a successful payment and needs an admin token. The payment
+// becomes Refunded once nothing is left to refund.
+func (c *Client) Refund(ctx context.Context, transactionID string, req RefundRequest) (*Refund, error) {
+	var resp Refund
+	if err := c.do(ctx, http.MethodPost, "/v1/payments/"+url.PathEscape(transactionID)+"/refund", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReconcileOptions describe a settlement file uploaded with Reconcile
+type ReconcileOptions struct {
+	// Name of the file, shown in the report
+	Source string
+	// Capture dates the file should settle, inclusive; the dates of the payments the file
+	// matched when zero
+	From, To time.Time
+}
+
+// Reconcile uploads a settlement file, CSV or JSON as contentType says, and returns the stored
+// report. Uploads are not retried, since each one stores a report.
+func (c *Client) Reconcile(ctx context.Context, contentType string, file []byte, opts ReconcileOptions) (*Reconciliation, error) {
+	query := url.Values{}
+	if opts.Source != "" {
+		query.Set("source", opts.Source)
+	}
+	if !opts.From.IsZero() {
+		query.Set("from", opts.From.Format("2006-01-02"))
+	}
+	if !opts.To.IsZero() {
+		query.Set("to", opts.To.Format("2006-01-02"))
+	}
+	path := "/v1/admin/reconciliations"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var resp Reconciliation
+	if err := c.doBody(ctx, http.MethodPost, path, contentType, file, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Reconciliations lists stored reconciliation reports, newest first, without their items. A zero
+// limit uses the service's default.
+func (c *Client) Reconciliations(ctx context.Context, limit int) ([]Reconciliation, error) {
+	path := "/v1/admin/reconciliations"
+	if limit > 0 {
+		path += "?limit=" + strconv.Itoa(limit)
+	}
+	var resp struct {
+		Reconciliations []Reconciliation `json:"reconciliations"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Reconciliations, nil
+}
+
+// Reconciliation gets a report with its items, only those with the given status unless it is empty
+func (c *Client) Reconciliation(ctx context.Context, id int64, status string) (*Reconciliation, error) {
+	path := "/v1/admin/reconciliations/" + strconv.FormatInt(id, 10)
+	if status != "" {
+		path += "?status=" + url.QueryEscape(status)
+	}
+	var resp Reconciliation
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReportOptions select the Almaty days a report covers and how it is grouped. Zero dates use the
+// service's defaults: to is today, from the start of to's month for daily reports and of its year
+// otherwise.
+type ReportOptions struct {
+	From, To time.Time
+	// "day" or "month"; revenue reports only, daily when empty
+	Period string
+}
+
+func (o ReportOptions) path(path, format string) string {
+	query := url.Values{}
+	if !o.From.IsZero() {
+		query.Set("from", o.From.Format("2006-01-02"))
+	}
+	if !o.To.IsZero() {
+		query.Set("to", o.To.Format("2006-01-02"))
+	}
+	if o.Period != "" {
+		query.Set("period", o.Period)
+	}
+	if format != "" {
+		query.Set("format", format)
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path
+}
+
+// RevenueReport gets revenue, refunds and net revenue by day or month with breakdowns by
+// subscription type and payment method
+func (c *Client) RevenueReport(ctx context.Context, opts ReportOptions) (*RevenueReport, error) {
+	var resp RevenueReport
+	if err := c.do(ctx, http.MethodGet, opts.path("/v1/admin/reports/revenue", ""), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CustomerStatement gets a customer's payments, refunds and reversals with totals per currency
+func (c *Client) CustomerStatement(ctx context.Context, customerID int64, opts ReportOptions) (*CustomerStatement, error) {
+	var resp CustomerStatement
+	path := "/v1/admin/reports/customers/" + strconv.FormatInt(customerID, 10) + "/statement"
+	if err := c.do(ctx, http.MethodGet, opts.path(path, ""), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ExportRevenueReport downloads the revenue report as a "csv" or "xlsx" file
+func (c *Client) ExportRevenueReport(ctx context.Context, opts ReportOptions, format string) ([]byte, error) {
+	var file []byte
+	if err := c.do(ctx, http.MethodGet, opts.path("/v1/admin/reports/revenue", format), nil, &file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ExportCustomerStatement downloads a customer's statement as a "csv" or "xlsx" file
+func (c *Client) ExportCustomerStatement(ctx context.Context, customerID int64, opts ReportOptions, format string) ([]byte, error) {
+	var file []byte
+	path := "/v1/admin/reports/customers/" + strconv.FormatInt(customerID, 10) + "/statement"
+	if err := c.do(ctx, http.MethodGet, opts.path(path, format), nil, &file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Send a request and decode the response into out. Only idempotent methods are retried.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	return c.doBody(ctx, method, path, "application/json", body, out)
+}
+
+// Like do for a body that is already encoded as contentType
+func (c *Client) doBody(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	attempts := 1
+	if method == http.MethodGet {
+		attempts += c.maxRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.backoff << (attempt - 1)):
+			}
+		}
+		if err = c.send(ctx, method, path, contentType, body, out); !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) send(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if ip, ok := ctx.Value(forwardedForKey{}).(string); ok && ip != "" {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	token := c.token
+	if c.tokenSource != nil {
+		if token, err = c.tokenSource(ctx); err != nil {
+			return fmt.Errorf("payment client: fetching token: %w", err)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &TransportError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	// Exports are handed back as they came
+	if raw, ok := out.(*[]byte); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Build an *Error from a non-2xx response, tolerating bodies that are not our envelope
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var envelope types.ErrorResponse
+	if err := json.Unmarshal(raw, &envelope); err == nil && envelope.Error.Code != "" {
+		apiErr.APIError = envelope.Error
+		return apiErr
+	}
+	apiErr.Code = types.ErrCodeUpstreamUnavailable
+	apiErr.Message = strings.TrimSpace(string(raw))
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *TransportError:
+		return true
+	case *Error:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+	return false
+}
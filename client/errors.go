@@ -0,0 +1,40 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"sportlife/types"
+)
+
+// Error is returned when the payment service answers with a non-2xx status
+type Error struct {
+	StatusCode int
+	// RetryAfter is the wait the service asked for with Retry-After, when it sent one
+	RetryAfter time.Duration
+	types.APIError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("payment service: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// TransportError is returned when the payment service could not be reached at all
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return "payment service unreachable: " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// IsCode reports whether err is an *Error carrying the given code
+func IsCode(err error, code types.ErrorCode) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
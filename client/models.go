@@ -0,0 +1,451 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+
+	"sportlife/types"
+)
+
+type InitPaymentRequest struct {
+	SubscriptionType string `json:"subscriptionType"`
+	// KZT when empty
+	Currency  types.Currency `json:"currency,omitempty"`
+	PromoCode string         `json:"promoCode,omitempty"`
+	// Lets per-customer promo rules be checked before the checkout page is shown
+	CustomerEmail string `json:"customerEmail,omitempty"`
+}
+
+type InitPaymentResponse struct {
+	Success          bool        `json:"success"`
+	TransactionID    string      `json:"transactionId"`
+	Message          string      `json:"message,omitempty"`
+	SubscriptionType string      `json:"subscriptionType"`
+	BasePrice        types.Money `json:"basePrice"`
+	PromoCode        string      `json:"promoCode,omitempty"`
+	Discount         types.Money `json:"discount"`
+	// What the customer will be charged after the discount
+	Amount   types.Money    `json:"amount"`
+	Currency types.Currency `json:"currency"`
+}
+
+// UnmarshalJSON decodes the amounts in the currency of the response
+func (r *InitPaymentResponse) UnmarshalJSON(b []byte) error {
+	type plain InitPaymentResponse
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return err
+	}
+	return inCurrency(r.Currency, &r.BasePrice, &r.Discount, &r.Amount)
+}
+
+type PaymentData struct {
+	TransactionID string      `json:"transactionId,omitempty"`
+	Email         string      `json:"email"`
+	Name          string      `json:"name"`
+	Phone         string      `json:"phone"`
+	CardNumber    string      `json:"cardNumber,omitempty"`
+	Amount        types.Money `json:"amount"`
+	// Currency of Amount; taken from the currency of Amount when empty
+	Currency types.Currency `json:"currency,omitempty"`
+	// Language of the customer's account, "ru" or "en"
+	Locale string `json:"locale,omitempty"`
+	// Pay with one of the customer's saved cards instead of CardNumber
+	PaymentMethodID int64 `json:"paymentMethodId,omitempty"`
+	// Save CardNumber for later payments once this one succeeds; CardExpiry (MM/YY) is then required
+	SaveCard   bool   `json:"saveCard,omitempty"`
+	CardExpiry string `json:"cardExpiry,omitempty"`
+	// Renew the subscription every month with the customer's default card; needs SaveCard or PaymentMethodID
+	AutoRenew bool `json:"autoRenew,omitempty"`
+}
+
+// MarshalJSON sends the currency of Amount unless Currency is set
+func (d PaymentData) MarshalJSON() ([]byte, error) {
+	type plain PaymentData
+	if d.Currency == "" {
+		d.Currency = d.Amount.Currency()
+	}
+	return json.Marshal(plain(d))
+}
+
+type CheckoutRequest struct {
+	TransactionID string `json:"transactionId,omitempty"`
+	CartID        int64  `json:"cartId"`
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	Phone         string `json:"phone"`
+	CardNumber    string `json:"cardNumber"`
+	// The cart's items as the customer confirmed them; the service charges the prices stored for the cart
+	CartItems []types.CartItem `json:"cartItems"`
+}
+
+type LineItem struct {
+	ItemID    string      `json:"itemId"`
+	Name      string      `json:"name"`
+	UnitPrice types.Money `json:"unitPrice"`
+	Quantity  int         `json:"quantity"`
+	Total     types.Money `json:"total"`
+}
+
+type ProcessPaymentResponse struct {
+	Success       bool   `json:"success"`
+	TransactionID string `json:"transactionId"`
+	Status        string `json:"status"`
+	// Needed to read the payment's status; only handed out here
+	StatusToken string `json:"statusToken"`
+	StatusURL   string `json:"statusUrl"`
+	EventsURL   string `json:"eventsUrl"`
+	Message     string `json:"message,omitempty"`
+}
+
+// Payment statuses reported by the service
+const (
+	StatusPending    = "Pending"
+	StatusProcessing = "Processing"
+	// The cardholder has to complete the 3-D Secure page at PaymentStatus.ChallengeURL
+	StatusAuthenticationRequired = "AuthenticationRequired"
+	// Held uncharged until the service's fraud review approves or rejects it
+	StatusOnHold   = "OnHold"
+	StatusSuccess  = "Success"
+	StatusDeclined = "Declined"
+	StatusFailed   = "Failed"
+	StatusRefunded = "Refunded"
+	StatusReversed = "Reversed"
+)
+
+const (
+	StageAuthenticating = "authenticating"
+	StageUnderReview    = "under_review"
+	StageCompleted      = "completed"
+)
+
+type PaymentStatus struct {
+	TransactionID string    `json:"transactionId"`
+	Status        string    `json:"status"`
+	Stage         string    `json:"stage"`
+	Message       string    `json:"message,omitempty"`
+	ChallengeURL  string    `json:"challengeUrl,omitempty"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// Finished reports whether the payment has reached its final status
+func (s *PaymentStatus) Finished() bool {
+	return s.Stage == StageCompleted
+}
+
+// AwaitingCardholder reports whether the payment is stalled until the cardholder authenticates
+func (s *PaymentStatus) AwaitingCardholder() bool {
+	return s.Stage == StageAuthenticating
+}
+
+// UnderReview reports whether the payment is held until a fraud review decides it, which can take hours
+func (s *PaymentStatus) UnderReview() bool {
+	return s.Stage == StageUnderReview
+}
+
+type Payment struct {
+	TransactionID    string         `json:"transactionId"`
+	CustomerEmail    string         `json:"customerEmail"`
+	SubscriptionType string         `json:"subscriptionType"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	// Amount in KZT at the exchange rate of the payment day; nil when no rate was known
+	BaseAmount    *types.Money `json:"baseAmount,omitempty"`
+	PaymentMethod string       `json:"paymentMethod"`
+	CardLastFour  string       `json:"cardLastFour"`
+	Status        string       `json:"status"`
+	PaymentTime   time.Time    `json:"paymentTime"`
+	Items         []LineItem   `json:"items,omitempty"`
+	// VAT included in the amount; nil for payments taken before VAT was recorded
+	Tax *TaxBreakdown `json:"tax,omitempty"`
+}
+
+// UnmarshalJSON decodes the amounts in the currency of the payment
+func (p *Payment) UnmarshalJSON(b []byte) error {
+	type plain Payment
+	if err := json.Unmarshal(b, (*plain)(p)); err != nil {
+		return err
+	}
+	amounts := []*types.Money{&p.Amount}
+	for i := range p.Items {
+		amounts = append(amounts, &p.Items[i].UnitPrice, &p.Items[i].Total)
+	}
+	if p.Tax != nil {
+		amounts = append(amounts, &p.Tax.Net, &p.Tax.Tax, &p.Tax.Gross)
+		for i := range p.Tax.Lines {
+			amounts = append(amounts, &p.Tax.Lines[i].Net, &p.Tax.Lines[i].Tax, &p.Tax.Lines[i].Gross)
+		}
+		for i := range p.Tax.Rates {
+			amounts = append(amounts, &p.Tax.Rates[i].Net, &p.Tax.Rates[i].Tax, &p.Tax.Rates[i].Gross)
+		}
+	}
+	return inCurrency(p.Currency, amounts...)
+}
+
+// VAT on one line of a payment
+type TaxLine struct {
+	Name   string      `json:"name"`
+	Rate   float64     `json:"rate"`
+	Exempt bool        `json:"exempt,omitempty"`
+	Net    types.Money `json:"net"`
+	Tax    types.Money `json:"tax"`
+	Gross  types.Money `json:"gross"`
+}
+
+// Total for one VAT rate
+type TaxRateTotal struct {
+	Rate   float64     `json:"rate"`
+	Exempt bool        `json:"exempt,omitempty"`
+	Net    types.Money `json:"net"`
+	Tax    types.Money `json:"tax"`
+	Gross  types.Money `json:"gross"`
+}
+
+type TaxBreakdown struct {
+	Lines []TaxLine      `json:"lines"`
+	Rates []TaxRateTotal `json:"rates"`
+	Net   types.Money    `json:"net"`
+	Tax   types.Money    `json:"tax"`
+	Gross types.Money    `json:"gross"`
+}
+
+// A payment as its customer sees it
+type CustomerPayment struct {
+	Payment
+	// Nil until the receipt has been generated
+	Receipt *PaymentReceipt `json:"receipt,omitempty"`
+}
+
+// UnmarshalJSON decodes the embedded payment in its currency along with the receipt
+func (p *CustomerPayment) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &p.Payment); err != nil {
+		return err
+	}
+	var rest struct {
+		Receipt *PaymentReceipt `json:"receipt"`
+	}
+	if err := json.Unmarshal(b, &rest); err != nil {
+		return err
+	}
+	p.Receipt = rest.Receipt
+	return nil
+}
+
+type PaymentReceipt struct {
+	// Path of the PDF download, relative to the service's base URL
+	URL         string    `json:"url"`
+	EmailStatus string    `json:"emailStatus"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// One page of the logged-in customer's payments
+type CustomerPayments struct {
+	Customer types.Customer    `json:"customer"`
+	Payments []CustomerPayment `json:"payments"`
+	Limit    int               `json:"limit"`
+	Offset   int               `json:"offset"`
+	// Number of payments across all pages
+	Total int `json:"total"`
+}
+
+// A card the customer saved for later payments
+type PaymentMethod struct {
+	ID        int64     `json:"id"`
+	Brand     string    `json:"brand"`
+	LastFour  string    `json:"lastFour"`
+	ExpMonth  int       `json:"expMonth"`
+	ExpYear   int       `json:"expYear"`
+	IsDefault bool      `json:"isDefault"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Outcomes of reconciliation items
+const (
+	ReconciliationMatched             = "matched"
+	ReconciliationMissingInDB         = "missing_in_db"
+	ReconciliationMissingInSettlement = "missing_in_settlement"
+	ReconciliationAmountMismatch      = "amount_mismatch"
+	ReconciliationDateMismatch        = "date_mismatch"
+	ReconciliationSettledButFailed    = "settled_but_failed"
+)
+
+// Kinds of settlement lines
+const (
+	SettlementPayment  = "payment"
+	SettlementRefund   = "refund"
+	SettlementReversal = "reversal"
+)
+
+// A settlement file checked against the recorded payments
+type Reconciliation struct {
+	ID     int64  `json:"id"`
+	Source string `json:"source"`
+	Format string `json:"format"`
+	// Capture dates of the payments the file was expected to settle, as YYYY-MM-DD
+	PeriodFrom string                `json:"periodFrom"`
+	PeriodTo   string                `json:"periodTo"`
+	Summary    ReconciliationSummary `json:"summary"`
+	CreatedBy  string                `json:"createdBy"`
+	CreatedAt  time.Time             `json:"createdAt"`
+	Items      []ReconciliationItem  `json:"items,omitempty"`
+}
+
+type ReconciliationSummary struct {
+	Matched             int `json:"matched"`
+	MissingInDB         int `json:"missingInDb"`
+	MissingInSettlement int `json:"missingInSettlement"`
+	AmountMismatch      int `json:"amountMismatch"`
+	DateMismatch        int `json:"dateMismatch"`
+	SettledButFailed    int `json:"settledButFailed"`
+}
+
+type ReconciliationItem struct {
+	Status        string `json:"status"`
+	TransactionID string `json:"transactionId"`
+	// One of the Settlement kinds; SettlementPayment for payments missing from the settlement
+	Type string `json:"type"`
+	// As the acquirer settled it; nil for items missing from the settlement
+	SettledAmount   *types.Money   `json:"settledAmount,omitempty"`
+	SettledCurrency types.Currency `json:"settledCurrency,omitempty"`
+	SettledOn       string         `json:"settledOn,omitempty"`
+	// As the service recorded it; nil for items missing from the database
+	RecordedAmount   *types.Money   `json:"recordedAmount,omitempty"`
+	RecordedCurrency types.Currency `json:"recordedCurrency,omitempty"`
+	PaymentStatus    string         `json:"paymentStatus,omitempty"`
+	PaymentTime      *time.Time     `json:"paymentTime,omitempty"`
+	Note             string         `json:"note,omitempty"`
+}
+
+func (i *ReconciliationItem) UnmarshalJSON(b []byte) error {
+	type plain ReconciliationItem
+	if err := json.Unmarshal(b, (*plain)(i)); err != nil {
+		return err
+	}
+	if i.SettledAmount != nil {
+		if err := inCurrency(i.SettledCurrency, i.SettledAmount); err != nil {
+			return err
+		}
+	}
+	if i.RecordedAmount != nil {
+		return inCurrency(i.RecordedCurrency, i.RecordedAmount)
+	}
+	return nil
+}
+
+// Money taken and given back over a day or month in one currency. SubscriptionType and
+// PaymentMethod are set on the rows of the matching breakdown only.
+type RevenueRow struct {
+	Period           string         `json:"period"`
+	Currency         types.Currency `json:"currency"`
+	SubscriptionType string         `json:"subscriptionType,omitempty"`
+	PaymentMethod    string         `json:"paymentMethod,omitempty"`
+	Payments         int            `json:"payments"`
+	Revenue          types.Money    `json:"revenue"`
+	// Refunds and reversals made in the period
+	Refunds  int         `json:"refunds"`
+	Refunded types.Money `json:"refunded"`
+	Net      types.Money `json:"net"`
+}
+
+func (r *RevenueRow) UnmarshalJSON(b []byte) error {
+	type plain RevenueRow
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return err
+	}
+	return inCurrency(r.Currency, &r.Revenue, &r.Refunded, &r.Net)
+}
+
+type RevenueReport struct {
+	From               string       `json:"from"`
+	To                 string       `json:"to"`
+	Period             string       `json:"period"`
+	TimeZone           string       `json:"timeZone"`
+	Totals             []RevenueRow `json:"totals"`
+	BySubscriptionType []RevenueRow `json:"bySubscriptionType"`
+	ByPaymentMethod    []RevenueRow `json:"byPaymentMethod"`
+}
+
+// A payment, refund or reversal on a customer's statement; refunds and reversals are negative
+type StatementLine struct {
+	Time             time.Time      `json:"time"`
+	Date             string         `json:"date"`
+	Kind             string         `json:"kind"`
+	TransactionID    string         `json:"transactionId"`
+	SubscriptionType string         `json:"subscriptionType"`
+	PaymentMethod    string         `json:"paymentMethod"`
+	CardLastFour     string         `json:"cardLastFour"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	Description      string         `json:"description,omitempty"`
+}
+
+func (l *StatementLine) UnmarshalJSON(b []byte) error {
+	type plain StatementLine
+	if err := json.Unmarshal(b, (*plain)(l)); err != nil {
+		return err
+	}
+	return inCurrency(l.Currency, &l.Amount)
+}
+
+type StatementTotal struct {
+	Currency types.Currency `json:"currency"`
+	Paid     types.Money    `json:"paid"`
+	Refunded types.Money    `json:"refunded"`
+	Net      types.Money    `json:"net"`
+}
+
+func (t *StatementTotal) UnmarshalJSON(b []byte) error {
+	type plain StatementTotal
+	if err := json.Unmarshal(b, (*plain)(t)); err != nil {
+		return err
+	}
+	return inCurrency(t.Currency, &t.Paid, &t.Refunded, &t.Net)
+}
+
+type CustomerStatement struct {
+	Customer types.Customer   `json:"customer"`
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	TimeZone string           `json:"timeZone"`
+	Lines    []StatementLine  `json:"lines"`
+	Totals   []StatementTotal `json:"totals"`
+}
+
+type RefundRequest struct {
+	// In the currency of the payment
+	Amount types.Money `json:"amount"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+type Refund struct {
+	RefundID      int64          `json:"refundId"`
+	TransactionID string         `json:"transactionId"`
+	Amount        types.Money    `json:"amount"`
+	Currency      types.Currency `json:"currency"`
+	Reason        string         `json:"reason,omitempty"`
+	CreatedAt     time.Time      `json:"createdAt"`
+}
+
+// UnmarshalJSON decodes the amount in the currency of the refund
+func (r *Refund) UnmarshalJSON(b []byte) error {
+	type plain Refund
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return err
+	}
+	return inCurrency(r.Currency, &r.Amount)
+}
+
+// Move amounts decoded before their currency was known into it. Responses from servers that
+// predate currencies carry none and stay in KZT.
+func inCurrency(currency types.Currency, amounts ...*types.Money) error {
+	if currency == "" {
+		return nil
+	}
+	for _, m := range amounts {
+		converted, err := m.WithCurrency(currency)
+		if err != nil {
+			return err
+		}
+		*m = converted
+	}
+	return nil
+}
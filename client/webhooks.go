@@ -0,0 +1,117 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+// Webhook event types sent by the payment service
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+	EventPaymentReversed  = "payment.reversed"
+	EventRefundCreated    = "refund.created"
+)
+
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookIDHeader        = "X-Webhook-ID"
+
+	// DefaultWebhookTolerance is how old a signed timestamp may be before the request is treated as a replay
+	DefaultWebhookTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("payment webhook: invalid signature")
+	ErrSignatureExpired = errors.New("payment webhook: timestamp outside tolerance")
+)
+
+// WebhookEvent is the body of every webhook request. Data holds a PaymentEvent or a Refund depending on Type.
+type WebhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// PaymentEvent is the data of payment.* events
+type PaymentEvent struct {
+	TransactionID    string         `json:"transactionId"`
+	Status           string         `json:"status"`
+	SubscriptionType string         `json:"subscriptionType"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	Message          string         `json:"message,omitempty"`
+}
+
+// UnmarshalJSON decodes the amount in the currency of the event
+func (e *PaymentEvent) UnmarshalJSON(b []byte) error {
+	type plain PaymentEvent
+	if err := json.Unmarshal(b, (*plain)(e)); err != nil {
+		return err
+	}
+	return inCurrency(e.Currency, &e.Amount)
+}
+
+// SignWebhook produces the X-Webhook-Signature value for body: HMAC-SHA256 over "<timestamp>.<body>".
+// The timestamp is part of the signed data so old requests cannot be replayed.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + ts + ",v1=" + webhookMAC(secret, ts, body)
+}
+
+// VerifySignature checks a signature header made by SignWebhook against the raw body.
+// Requests signed more than tolerance ago (or in the future) are rejected.
+func VerifySignature(secret, signatureHeader string, body []byte, tolerance time.Duration) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(signatureHeader, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(webhookMAC(secret, timestamp, body)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	age := time.Since(time.Unix(ts, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// VerifyWebhook checks the X-Webhook-Signature header against the raw request body and decodes the event
+func VerifyWebhook(secret, signatureHeader string, body []byte, tolerance time.Duration) (*WebhookEvent, error) {
+	if err := VerifySignature(secret, signatureHeader, body, tolerance); err != nil {
+		return nil, err
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func webhookMAC(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,102 @@
+// Command gateway-signer signs sandbox gateway callbacks so POST /v1/gateway/callbacks/sandbox
+// can be exercised locally.
+//
+//	gateway-signer -type payment.captured -transaction TRX-123 -amount 25000 -send
+//	gateway-signer -file callback.json
+//
+// The secret comes from -secret or GATEWAY_SANDBOX_CALLBACK_SECRET, the same variable the service reads.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"sportlife/client"
+	"sportlife/types"
+)
+
+func main() {
+	secret := flag.String("secret", os.Getenv("GATEWAY_SANDBOX_CALLBACK_SECRET"), "shared callback secret")
+	file := flag.String("file", "", "sign this JSON payload instead of building one (- for stdin)")
+	eventType := flag.String("type", "payment.captured", "event type: payment.captured, payment.failed or payment.reversed")
+	transactionID := flag.String("transaction", "", "transaction ID the event is about")
+	amount := flag.String("amount", "", "amount the acquirer reports, e.g. 25000.00 (omitted when empty)")
+	currency := flag.String("currency", "", "currency of -amount, e.g. RUB (omitted when empty)")
+	eventID := flag.String("id", "", "provider event ID (random when empty)")
+	send := flag.Bool("send", false, "POST the signed callback instead of printing it")
+	baseURL := flag.String("url", "http://localhost:8081", "payment service base URL used with -send")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("set -secret or GATEWAY_SANDBOX_CALLBACK_SECRET")
+	}
+
+	body, err := payload(*file, *eventID, *eventType, *transactionID, *amount, types.Currency(*currency))
+	if err != nil {
+		log.Fatal(err)
+	}
+	signature := client.SignWebhook(*secret, time.Now(), body)
+
+	if !*send {
+		fmt.Printf("X-Sandbox-Signature: %s\n\n%s\n", signature, body)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*baseURL, "/")+"/v1/gateway/callbacks/sandbox", bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sandbox-Signature", signature)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s\n%s\n", resp.Status, respBody)
+}
+
+func payload(file, eventID, eventType, transactionID, amount string, currency types.Currency) ([]byte, error) {
+	switch file {
+	case "":
+	case "-":
+		return io.ReadAll(os.Stdin)
+	default:
+		return os.ReadFile(file)
+	}
+
+	if transactionID == "" {
+		return nil, fmt.Errorf("-transaction is required unless -file is given")
+	}
+	if eventID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		eventID = "sbx_" + hex.EncodeToString(b)
+	}
+	event := map[string]interface{}{"id": eventID, "type": eventType, "transactionId": transactionID}
+	if amount != "" {
+		m, err := types.ParseMoney(amount, currency)
+		if err != nil {
+			return nil, err
+		}
+		event["amount"] = m
+	}
+	if currency != "" {
+		if !currency.Valid() {
+			return nil, fmt.Errorf("unknown currency %q", currency)
+		}
+		event["currency"] = currency
+	}
+	return json.Marshal(event)
+}
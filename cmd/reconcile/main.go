@@ -0,0 +1,142 @@
+// Command reconcile uploads an acquirer settlement file to the payment service, which matches it
+// against the recorded payments and stores the report for finance to review.
+//
+//	reconcile -file settlement_2026-10-18.csv
+//	reconcile -file settlement.json -from 2026-10-15 -to 2026-10-17
+//
+// Settlement CSVs have a header row naming transaction_id, amount, settled_at and optionally type
+// and currency; JSON files look like {"items": [{"transactionId", "type", "amount", "currency", "settledAt"}]}.
+// Lines are payments unless their type says refund or reversal, or their amount is negative.
+// The admin token comes from -token or PAYMENT_SERVICE_TOKEN. The command exits with status 2
+// when the report has any item that did not match, so a scheduled run can alert on it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sportlife/client"
+)
+
+func main() {
+	file := flag.String("file", "", "settlement file to reconcile (- for stdin)")
+	format := flag.String("format", "", "csv or json (taken from the file extension when empty)")
+	source := flag.String("source", "", "name of the file in the report (the file name when empty)")
+	from := flag.String("from", "", "first capture date the file should settle, e.g. 2026-10-15")
+	to := flag.String("to", "", "last capture date the file should settle, inclusive")
+	token := flag.String("token", os.Getenv("PAYMENT_SERVICE_TOKEN"), "admin bearer token")
+	baseURL := flag.String("url", envOr("PAYMENT_SERVICE_URL", client.DefaultBaseURL), "payment service base URL")
+	showMatched := flag.Bool("matched", false, "list matched items too, not only discrepancies")
+	flag.Parse()
+
+	if *file == "" {
+		log.Fatal("-file is required")
+	}
+	if *token == "" {
+		log.Fatal("set -token or PAYMENT_SERVICE_TOKEN")
+	}
+	contentType, err := fileContentType(*file, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := client.ReconcileOptions{Source: *source}
+	if opts.Source == "" && *file != "-" {
+		opts.Source = filepath.Base(*file)
+	}
+	if opts.From, err = parseDate("-from", *from); err != nil {
+		log.Fatal(err)
+	}
+	if opts.To, err = parseDate("-to", *to); err != nil {
+		log.Fatal(err)
+	}
+
+	body, err := readFile(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := client.New(client.Options{BaseURL: *baseURL, Token: *token, Timeout: 2 * time.Minute})
+	rec, err := c.Reconcile(context.Background(), contentType, body, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printReport(os.Stdout, rec, *showMatched)
+	s := rec.Summary
+	if s.MissingInDB+s.MissingInSettlement+s.AmountMismatch+s.DateMismatch+s.SettledButFailed > 0 {
+		os.Exit(2)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fileContentType(file, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	}
+	switch format {
+	case "csv":
+		return "text/csv", nil
+	case "json":
+		return "application/json", nil
+	}
+	return "", fmt.Errorf("cannot tell the format of %q, pass -format csv or -format json", file)
+}
+
+func parseDate(flagName, v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	day, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a date like 2026-01-31", flagName)
+	}
+	return day, nil
+}
+
+func readFile(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+func printReport(w io.Writer, rec *client.Reconciliation, showMatched bool) {
+	period := "none"
+	if rec.PeriodFrom != "" {
+		period = rec.PeriodFrom + " to " + rec.PeriodTo
+	}
+	s := rec.Summary
+	fmt.Fprintf(w, "Reconciliation %d of %s (captures %s)\n", rec.ID, rec.Source, period)
+	fmt.Fprintf(w, "  matched %d, missing in DB %d, missing in settlement %d, amount mismatch %d, date mismatch %d, settled but failed %d\n\n",
+		s.Matched, s.MissingInDB, s.MissingInSettlement, s.AmountMismatch, s.DateMismatch, s.SettledButFailed)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tTRANSACTION\tTYPE\tSETTLED\tRECORDED\tNOTE")
+	for _, item := range rec.Items {
+		if item.Status == client.ReconciliationMatched && !showMatched {
+			continue
+		}
+		settled, recorded := "-", "-"
+		if item.SettledAmount != nil {
+			settled = item.SettledAmount.Decimal() + " " + string(item.SettledCurrency) + " on " + item.SettledOn
+		}
+		if item.RecordedAmount != nil {
+			recorded = item.RecordedAmount.Decimal() + " " + string(item.RecordedCurrency)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", item.Status, item.TransactionID, item.Type, settled, recorded, item.Note)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,169 @@
+// Command report fetches financial reports from the payment service for accounting: revenue,
+// refunds and net revenue by Almaty day or month, and per-customer statements.
+//
+//	report revenue -period month -from 2026-01-01 -to 2026-09-30
+//	report revenue -from 2026-10-01 -to 2026-10-31 -format xlsx
+//	report statement -customer 42 -format csv -o statement.csv
+//
+// Without -format the report is printed as a table. With -format csv or xlsx it is saved to -o,
+// revenue.<format> or statement_<customer>.<format> by default. The admin token comes from -token
+// or PAYMENT_SERVICE_TOKEN.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"sportlife/client"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+	flags := flag.NewFlagSet("report "+command, flag.ExitOnError)
+	from := flags.String("from", "", "first day of the report, e.g. 2026-10-01")
+	to := flags.String("to", "", "last day of the report, inclusive (today when empty)")
+	format := flags.String("format", "", "csv or xlsx to save an export instead of printing the report")
+	output := flags.String("o", "", "file to save the export to")
+	token := flags.String("token", os.Getenv("PAYMENT_SERVICE_TOKEN"), "admin bearer token")
+	baseURL := flags.String("url", envOr("PAYMENT_SERVICE_URL", client.DefaultBaseURL), "payment service base URL")
+	var period *string
+	var customerID *int64
+	switch command {
+	case "revenue":
+		period = flags.String("period", "day", "day or month")
+	case "statement":
+		customerID = flags.Int64("customer", 0, "customer ID")
+	default:
+		usage()
+	}
+	flags.Parse(os.Args[2:])
+
+	if *token == "" {
+		log.Fatal("set -token or PAYMENT_SERVICE_TOKEN")
+	}
+	if *format != "" && *format != "csv" && *format != "xlsx" {
+		log.Fatal("-format must be csv or xlsx")
+	}
+	var opts client.ReportOptions
+	var err error
+	if opts.From, err = parseDate("-from", *from); err != nil {
+		log.Fatal(err)
+	}
+	if opts.To, err = parseDate("-to", *to); err != nil {
+		log.Fatal(err)
+	}
+	if period != nil {
+		opts.Period = *period
+	}
+	if customerID != nil && *customerID == 0 {
+		log.Fatal("-customer is required")
+	}
+
+	ctx := context.Background()
+	c := client.New(client.Options{BaseURL: *baseURL, Token: *token, Timeout: time.Minute})
+	if *format != "" {
+		var file []byte
+		name := *output
+		if customerID != nil {
+			file, err = c.ExportCustomerStatement(ctx, *customerID, opts, *format)
+			if name == "" {
+				name = fmt.Sprintf("statement_%d.%s", *customerID, *format)
+			}
+		} else {
+			file, err = c.ExportRevenueReport(ctx, opts, *format)
+			if name == "" {
+				name = "revenue." + *format
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(name, file, 0o644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Saved %s\n", name)
+		return
+	}
+
+	if customerID != nil {
+		statement, err := c.CustomerStatement(ctx, *customerID, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printStatement(os.Stdout, statement)
+		return
+	}
+	report, err := c.RevenueReport(ctx, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printRevenue(os.Stdout, report)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: report revenue|statement [flags]; run report <command> -h for the flags")
+	os.Exit(2)
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func parseDate(flagName, v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	day, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a date like 2026-01-31", flagName)
+	}
+	return day, nil
+}
+
+func printRevenue(w io.Writer, report *client.RevenueReport) {
+	fmt.Fprintf(w, "Revenue by %s, %s to %s (%s)\n\n", report.Period, report.From, report.To, report.TimeZone)
+	printRevenueRows(w, "", report.Totals, func(client.RevenueRow) string { return "" })
+	fmt.Fprintln(w)
+	printRevenueRows(w, "SUBSCRIPTION TYPE", report.BySubscriptionType, func(row client.RevenueRow) string { return row.SubscriptionType })
+	fmt.Fprintln(w)
+	printRevenueRows(w, "PAYMENT METHOD", report.ByPaymentMethod, func(row client.RevenueRow) string { return row.PaymentMethod })
+}
+
+// Print rows as a table, with the breakdown group each row belongs to under groupTitle
+func printRevenueRows(w io.Writer, groupTitle string, rows []client.RevenueRow, group func(client.RevenueRow) string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "PERIOD\tCURRENCY\t%s\tPAYMENTS\tREVENUE\tREFUNDS\tREFUNDED\tNET\t\n", groupTitle)
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\t%s\t%s\t\n", row.Period, row.Currency, group(row),
+			row.Payments, row.Revenue.Decimal(), row.Refunds, row.Refunded.Decimal(), row.Net.Decimal())
+	}
+	tw.Flush()
+}
+
+func printStatement(w io.Writer, statement *client.CustomerStatement) {
+	fmt.Fprintf(w, "Statement of %s <%s>, %s to %s (%s)\n\n", statement.Customer.Name, statement.Customer.Email,
+		statement.From, statement.To, statement.TimeZone)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tKIND\tTRANSACTION\tSUBSCRIPTION\tAMOUNT\tDESCRIPTION")
+	for _, line := range statement.Lines {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s %s\t%s\n", line.Date, line.Kind, line.TransactionID, line.SubscriptionType,
+			line.Amount.Decimal(), line.Currency, line.Description)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	for _, t := range statement.Totals {
+		fmt.Fprintf(w, "%s: paid %s, refunded %s, net %s\n", t.Currency, t.Paid.Decimal(), t.Refunded.Decimal(), t.Net.Decimal())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"sportlife/types"
+)
+
+const (
+	defaultCustomerPaymentLimit = 20
+	maxCustomerPaymentLimit     = 100
+)
+
+// Languages customers can be written to in
+var customerLocales = []string{"ru", "en"}
+
+const defaultCustomerLocale = "ru"
+
+// A payment as its customer sees it, with the receipt once one has been generated
+type CustomerPayment struct {
+	Payment
+	Receipt *PaymentReceipt `json:"receipt,omitempty"`
+}
+
+type PaymentReceipt struct {
+	// Where the customer can download the PDF
+	URL         string    `json:"url"`
+	EmailStatus string    `json:"emailStatus"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Lowercase an email and drop surrounding spaces, so the same mailbox always matches
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Reduce a phone number to + and its digits, reading a Kazakh or Russian 8XXXXXXXXXX as +7XXXXXXXXXX.
+// Returns "" when there are no digits.
+func normalizePhone(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, phone)
+	if len(digits) == 11 && digits[0] == '8' {
+		digits = "7" + digits[1:]
+	}
+	if digits == "" {
+		return ""
+	}
+	return "+" + digits
+}
+
+// Build the customer record a payment is made by
+func paymentCustomer(data PaymentData) types.Customer {
+	locale := data.Locale
+	if locale == "" {
+		locale = defaultCustomerLocale
+	}
+	return types.Customer{Name: strings.TrimSpace(data.Name), Email: data.Email, Phone: data.Phone, Locale: locale}
+}
+
+// Look up the logged-in caller's customer account, writing a 404 when they have none yet
+func loadCurrentCustomer(w http.ResponseWriter, r *http.Request) (*types.Customer, bool) {
+	customer, err := getCustomerForUser(r.Context(), userID(r.Context()), userEmail(r.Context()))
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "No payments have been made with this account's email yet")
+		return nil, false
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading customer", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading customer")
+		return nil, false
+	}
+	return customer, true
+}
+
+// List the caller's payments, newest first, offset/limit paginated
+func handleListMyPayments(w http.ResponseWriter, r *http.Request) {
+	limit, offset := defaultCustomerPaymentLimit, 0
+	var fields []types.FieldError
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCustomerPaymentLimit {
+			fields = append(fields, types.FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxCustomerPaymentLimit)})
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fields = append(fields, types.FieldError{Field: "offset", Message: "must be zero or more"})
+		}
+		offset = n
+	}
+	if len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid pagination", fields...)
+		return
+	}
+
+	customer, ok := loadCurrentCustomer(w, r)
+	if !ok {
+		return
+	}
+	payments, total, err := listCustomerPayments(r.Context(), customer.ID, limit, offset)
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing customer payments", "customer_id", customer.ID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payments")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"customer": customer,
+		"payments": payments,
+		"limit":    limit,
+		"offset":   offset,
+		"total":    total,
+	})
+}
+
+// Download the PDF receipt of one of the caller's payments
+func handleGetMyReceipt(w http.ResponseWriter, r *http.Request) {
+	customer, ok := loadCurrentCustomer(w, r)
+	if !ok {
+		return
+	}
+	path, err := getCustomerReceiptPath(r.Context(), customer.ID, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Receipt not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading receipt", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading receipt")
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		logFrom(r.Context()).Error("Error opening receipt file", "path", path, "error", err)
+		writeError(w, r, types.ErrCodeNotFound, "Receipt not found")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logFrom(r.Context()).Error("Error reading receipt file", "path", path, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading receipt")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="receipt_`+r.PathValue("id")+`.pdf"`)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -1,68 +1,74 @@
 package main
 
 import (
-	"fmt"
-	"net/smtp"
-	"os"
-)
-
-type EmailConfig struct {
-    Host     string
-    Port     int
-    Username string
-    Password string
-    From     string
-}
-
-var emailConfig = EmailConfig{
-    Host:     "smtp.gmail.com",
-    Port:     587,
-    Username: os.Getenv("EMAIL_USERNAME"),
-    Password: os.Getenv("EMAIL_PASSWORD"),
-    From:     "your-email@gmail.com",
-}
+	"context"
+	"time"
 
-func sendEmail(to, receiptPath string, payment SubscriptionPayment) error {
-    subject := "Your SportLife Gym Subscription Receipt"
-    body := fmt.Sprintf(`
-        Dear %s,
+	"gopkg.in/gomail.v2"
+)
 
-        Thank you for your subscription to SportLife Gym!
+const (
+	smtpHost = "smtp.mail.ru"
+	smtpPort = 587
+)
 
-        Transaction Details:
-        - Transaction ID: %s
-        - Subscription Type: %s
-        - Amount: %.2f KZT
-        - Date: %s
+// Caps concurrent SMTP connections, including sends abandoned after a timeout that are still running
+var smtpSlots chan struct{}
 
-        Your payment has been processed successfully.
-        Please find your receipt attached to this email.
+func limitSMTPConnections(n int) {
+	smtpSlots = make(chan struct{}, n)
+}
 
-        If you have any questions, please don't hesitate to contact us.
+// Send the receipt email, giving up when ctx is done
+func sendEmail(ctx context.Context, to, receiptPath string) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", config.Email)
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", "Квитанция об оплате - SportLife")
+	m.SetBody("text/html", `
+		<h2>Спасибо за оплату!</h2>
+		<p>Ваша квитанция во вложении.</p>
+		<br>
+		<p>С уважением,<br>SportLife</p>
+	`)
+	m.Attach(receiptPath)
 
-        Best regards,
-        SportLife Gym Team
-    `, payment.Customer.Name, payment.TransactionID, payment.SubscriptionType, 
-       payment.Amount, payment.PaymentTime.Format("2006-01-02 15:04:05"))
+	// Use Mail.ru SMTP settings
+	d := gomail.NewDialer(smtpHost, smtpPort, config.Email, config.Password)
 
-    // Create email headers
-    headers := make(map[string]string)
-    headers["From"] = emailConfig.From
-    headers["To"] = to
-    headers["Subject"] = subject
-    headers["MIME-Version"] = "1.0"
-    headers["Content-Type"] = "text/plain; charset=UTF-8"
+	if smtpSlots != nil {
+		select {
+		case smtpSlots <- struct{}{}:
+		case <-ctx.Done():
+			emailsSentTotal.WithLabelValues("failure").Inc()
+			return ctx.Err()
+		}
+	}
 
-    // Compose message
-    message := ""
-    for key, value := range headers {
-        message += fmt.Sprintf("%s: %s\r\n", key, value)
-    }
-    message += "\r\n" + body
+	// gomail has no context support, so the send runs on its own and keeps its slot until it really ends
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- d.DialAndSend(m)
+		emailSendDuration.Observe(time.Since(start).Seconds())
+		if smtpSlots != nil {
+			<-smtpSlots
+		}
+	}()
 
-    // Connect to SMTP server
-    auth := smtp.PlainAuth("", emailConfig.Username, emailConfig.Password, emailConfig.Host)
-    addr := fmt.Sprintf("%s:%d", emailConfig.Host, emailConfig.Port)
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		emailsSentTotal.WithLabelValues("failure").Inc()
+		logFrom(ctx).Error("Error sending email", "to", to, "error", err)
+		return err
+	}
+	emailsSentTotal.WithLabelValues("success").Inc()
 
-    return smtp.SendMail(addr, auth, emailConfig.From, []string{to}, []byte(message))
-} 
\ No newline at end of file
+	logFrom(ctx).Info("Email sent successfully", "to", to)
+	return nil
+}
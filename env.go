@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Read a positive integer from the environment, falling back to def
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// Read a positive duration such as "30s" from the environment, falling back to def
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// Whether APP_ENV marks a development or test deployment
+func developmentEnv() bool {
+	env := os.Getenv("APP_ENV")
+	return env == "development" || env == "test"
+}
+
+// Fail startup when a key that protects stored data is unset, unless in development or test
+func requireKeys(names ...string) {
+	if developmentEnv() {
+		return
+	}
+	for _, name := range names {
+		if os.Getenv(name) == "" {
+			log.Fatalf("%s must be set unless APP_ENV is development or test", name)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"sportlife/types"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Get the caller's request ID or generate a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	r.Header.Set(requestIDHeader, id)
+	return id
+}
+
+func newErrorResponse(r *http.Request, code types.ErrorCode, message string, fields ...types.FieldError) types.ErrorResponse {
+	return types.ErrorResponse{Error: types.APIError{
+		Code:      code,
+		Message:   message,
+		Fields:    fields,
+		RequestID: requestID(r),
+	}}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write the error envelope with the status that matches its code
+func writeError(w http.ResponseWriter, r *http.Request, code types.ErrorCode, message string, fields ...types.FieldError) {
+	w.Header().Set(requestIDHeader, requestID(r))
+	writeJSON(w, code.HTTPStatus(), newErrorResponse(r, code, message, fields...))
+}
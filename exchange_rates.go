@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+// Currency reports and base amounts are converted to
+const baseCurrency = types.KZT
+
+// Currencies customers can pay in, one per country we have branches in
+var paymentCurrencies = []types.Currency{types.KZT, types.RUB, types.UZS}
+
+const exchangeRatesPath = "exchange_rates.json"
+
+const rateDateLayout = "2006-01-02"
+
+// Units of baseCurrency one unit of Currency buys, from EffectiveDate until the next rate
+type ExchangeRate struct {
+	Currency      types.Currency `json:"currency"`
+	Rate          json.Number    `json:"rate"`
+	EffectiveDate string         `json:"effectiveDate"`
+	Source        string         `json:"source,omitempty"`
+	UpdatedAt     *time.Time     `json:"updatedAt,omitempty"`
+}
+
+type ExchangeRatesRequest struct {
+	Rates []ExchangeRate `json:"rates"`
+}
+
+func isPaymentCurrency(c types.Currency) bool {
+	for _, pc := range paymentCurrencies {
+		if c == pc {
+			return true
+		}
+	}
+	return false
+}
+
+func paymentCurrencyList() string {
+	names := make([]string, len(paymentCurrencies))
+	for i, c := range paymentCurrencies {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Load exchange_rates.json into the rate table, if the file exists. The file is the way to seed
+// rates on deploy and never overwrites a stored rate, so corrections made through the admin API
+// survive restarts.
+func loadExchangeRates() error {
+	file, err := os.ReadFile(exchangeRatesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var req ExchangeRatesRequest
+	if err := json.Unmarshal(file, &req); err != nil {
+		return err
+	}
+	if fields := validateExchangeRates(req.Rates); len(fields) > 0 {
+		return fmt.Errorf("%s: %s %s", exchangeRatesPath, fields[0].Field, fields[0].Message)
+	}
+	if err := seedExchangeRates(req.Rates, "file:"+exchangeRatesPath); err != nil {
+		// Payments in other currencies would go unconverted, so refuse to start rather than run without rates
+		return fmt.Errorf("storing %s: %w", exchangeRatesPath, err)
+	}
+	return nil
+}
+
+func validateExchangeRates(rates []ExchangeRate) []types.FieldError {
+	var fields []types.FieldError
+	if len(rates) == 0 {
+		fields = append(fields, types.FieldError{Field: "rates", Message: "must contain at least one rate"})
+	}
+	for i, rate := range rates {
+		if rate.Currency == baseCurrency || !rate.Currency.Valid() {
+			fields = append(fields, types.FieldError{Field: fmt.Sprintf("rates[%d].currency", i), Message: "must be a supported currency other than " + string(baseCurrency)})
+		}
+		if r, ok := new(big.Rat).SetString(rate.Rate.String()); !ok || r.Sign() <= 0 {
+			fields = append(fields, types.FieldError{Field: fmt.Sprintf("rates[%d].rate", i), Message: "must be a positive number"})
+		}
+		if _, err := time.Parse(rateDateLayout, rate.EffectiveDate); rate.EffectiveDate != "" && err != nil {
+			fields = append(fields, types.FieldError{Field: fmt.Sprintf("rates[%d].effectiveDate", i), Message: "must be a date like 2026-01-31"})
+		}
+	}
+	return fields
+}
+
+// Convert an amount to the base currency at the rate in effect on the given day. ok is false
+// when no rate is known for that day.
+func convertToBase(ctx context.Context, amount types.Money, on time.Time) (converted types.Money, ok bool, err error) {
+	if amount.Currency() == baseCurrency {
+		return amount, true, nil
+	}
+	rate, err := getExchangeRate(ctx, amount.Currency(), on)
+	if err != nil || rate == "" {
+		return types.Money{}, false, err
+	}
+	r, valid := new(big.Rat).SetString(rate)
+	if !valid {
+		return types.Money{}, false, fmt.Errorf("invalid exchange rate %q for %s", rate, amount.Currency())
+	}
+	return amount.Exchange(baseCurrency, r, types.RoundHalfUp), true, nil
+}
+
+func handleListExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := listExchangeRates()
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing exchange rates", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading exchange rates")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"baseCurrency": baseCurrency, "rates": rates})
+}
+
+// Add or replace rates; a rate without an effective date applies from today
+func handleSetExchangeRates(w http.ResponseWriter, r *http.Request) {
+	var req ExchangeRatesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+	if fields := validateExchangeRates(req.Rates); len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid exchange rates", fields...)
+		return
+	}
+
+	if err := upsertExchangeRates(req.Rates, "admin:"+userID(r.Context())); err != nil {
+		logFrom(r.Context()).Error("Error storing exchange rates", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error saving exchange rates")
+		return
+	}
+	logFrom(r.Context()).Info("Exchange rates updated", "count", len(req.Rates))
+	handleListExchangeRates(w, r)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+const fraudRulesPath = "fraud_rules.json"
+
+const (
+	fraudDecisionAllow  = "allow"
+	fraudDecisionReview = "review"
+	fraudDecisionDeny   = "deny"
+)
+
+const (
+	fraudReviewPending  = "pending"
+	fraudReviewApproved = "approved"
+	fraudReviewRejected = "rejected"
+)
+
+// A time.Duration written as "1h" in the rules file
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = jsonDuration(parsed)
+	return err
+}
+
+type fraudRules struct {
+	ReviewScore int `json:"reviewScore"`
+	DenyScore   int `json:"denyScore"`
+	Velocity    struct {
+		Window      jsonDuration `json:"window"`
+		MaxPerCard  int          `json:"maxPerCard"`
+		MaxPerEmail int          `json:"maxPerEmail"`
+		MaxPerIP    int          `json:"maxPerIP"`
+		Weight      int          `json:"weight"`
+	} `json:"velocity"`
+	// In the base currency; zero turns the rule off
+	AmountThresholds struct {
+		Default             types.Money            `json:"default"`
+		Weight              int                    `json:"weight"`
+		PerSubscriptionType map[string]types.Money `json:"perSubscriptionType"`
+	} `json:"amountThresholds"`
+	BINCountry struct {
+		Weight        int                 `json:"weight"`
+		BINs          map[string]string   `json:"bins"`
+		PhonePrefixes map[string][]string `json:"phonePrefixes"`
+	} `json:"binCountry"`
+	DisposableEmail struct {
+		Weight  int      `json:"weight"`
+		Domains []string `json:"domains"`
+	} `json:"disposableEmail"`
+	Declines struct {
+		Window jsonDuration `json:"window"`
+		Max    int          `json:"max"`
+		Weight int          `json:"weight"`
+	} `json:"declines"`
+}
+
+var fraudConfig fraudRules
+
+// Load the fraud screening rules from fraud_rules.json
+func loadFraudRules() error {
+	file, err := os.ReadFile(fraudRulesPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(file, &fraudConfig); err != nil {
+		return err
+	}
+	if fraudConfig.ReviewScore <= 0 || fraudConfig.DenyScore < fraudConfig.ReviewScore {
+		return fmt.Errorf("%s: need 0 < reviewScore <= denyScore", fraudRulesPath)
+	}
+	// Thresholds are compared with base currency amounts in minor units
+	t := &fraudConfig.AmountThresholds
+	if t.Default, err = t.Default.WithCurrency(baseCurrency); err != nil {
+		return fmt.Errorf("%s: default amount threshold: %w", fraudRulesPath, err)
+	}
+	for subscriptionType, threshold := range t.PerSubscriptionType {
+		if t.PerSubscriptionType[subscriptionType], err = threshold.WithCurrency(baseCurrency); err != nil {
+			return fmt.Errorf("%s: amount threshold of %s: %w", fraudRulesPath, subscriptionType, err)
+		}
+	}
+	// Only the first six digits of a card are kept, so longer BINs could never match
+	for bin := range fraudConfig.BINCountry.BINs {
+		if len(bin) != 6 {
+			return fmt.Errorf("%s: BIN %q must be six digits", fraudRulesPath, bin)
+		}
+	}
+	return nil
+}
+
+// What the screening engine knows about a payment
+type fraudInput struct {
+	Email           string
+	Phone           string
+	CardBIN         string
+	CardFingerprint string
+	ClientIP        string
+	Amount          types.Money
+	// Amount in the base currency, nil when no exchange rate was known
+	BaseAmount       *types.Money
+	SubscriptionType string
+}
+
+type fraudScreening struct {
+	Score    int
+	Decision string
+	Reasons  []string
+}
+
+// Screening result stored alongside a payment transaction
+type paymentRisk struct {
+	CardFingerprint string
+	ClientIP        string
+	Screening       fraudScreening
+}
+
+// Counts of earlier payments the velocity and decline rules look at
+type fraudHistory struct {
+	CardPayments, EmailPayments, IPPayments int
+	CardDeclines, EmailDeclines             int
+}
+
+// Score a payment against every rule and turn the total into an allow/review/deny decision.
+// If the payment history cannot be loaded the payment is sent to review rather than blocked.
+func screenPayment(ctx context.Context, in fraudInput) fraudScreening {
+	history, err := loadFraudHistory(ctx, in.CardFingerprint, in.Email, in.ClientIP,
+		time.Duration(fraudConfig.Velocity.Window), time.Duration(fraudConfig.Declines.Window))
+	if err != nil {
+		logFrom(ctx).Error("Error loading payment history for fraud screening", "error", err)
+		s := evaluateFraudRules(in, fraudHistory{})
+		s.Reasons = append(s.Reasons, "history_unavailable")
+		if s.Decision == fraudDecisionAllow {
+			s.Decision = fraudDecisionReview
+		}
+		fraudDecisionsTotal.WithLabelValues(s.Decision).Inc()
+		return s
+	}
+	s := evaluateFraudRules(in, history)
+	fraudDecisionsTotal.WithLabelValues(s.Decision).Inc()
+	return s
+}
+
+func evaluateFraudRules(in fraudInput, history fraudHistory) fraudScreening {
+	var s fraudScreening
+	hit := func(weight int, reason string) {
+		s.Score += weight
+		s.Reasons = append(s.Reasons, reason)
+	}
+
+	// Each velocity rule counts on its own: a card, email and IP all over their limits is worse than one
+	v := fraudConfig.Velocity
+	if v.MaxPerCard > 0 && history.CardPayments >= v.MaxPerCard {
+		hit(v.Weight, "velocity_card")
+	}
+	if v.MaxPerEmail > 0 && history.EmailPayments >= v.MaxPerEmail {
+		hit(v.Weight, "velocity_email")
+	}
+	if v.MaxPerIP > 0 && history.IPPayments >= v.MaxPerIP {
+		hit(v.Weight, "velocity_ip")
+	}
+
+	threshold, ok := fraudConfig.AmountThresholds.PerSubscriptionType[in.SubscriptionType]
+	if !ok {
+		threshold = fraudConfig.AmountThresholds.Default
+	}
+	// Thresholds are in the base currency
+	amount := in.Amount
+	if in.BaseAmount != nil {
+		amount = *in.BaseAmount
+	}
+	// Without a rate the threshold cannot be checked, so a person has to look at the amount
+	unconverted := threshold.IsPositive() && amount.Currency() != baseCurrency
+	if unconverted {
+		s.Reasons = append(s.Reasons, "amount_unconverted")
+	} else if cmp, err := amount.Cmp(threshold); threshold.IsPositive() && err == nil && cmp > 0 {
+		hit(fraudConfig.AmountThresholds.Weight, "amount_over_threshold")
+	}
+
+	if binCountry, ok := binCountry(in.CardBIN); ok {
+		if countries := phoneCountries(in.Phone); len(countries) > 0 && !contains(countries, binCountry) {
+			hit(fraudConfig.BINCountry.Weight, "bin_country_mismatch")
+		}
+	}
+
+	if at := strings.LastIndex(in.Email, "@"); at >= 0 {
+		domain := strings.ToLower(in.Email[at+1:])
+		if contains(fraudConfig.DisposableEmail.Domains, domain) {
+			hit(fraudConfig.DisposableEmail.Weight, "disposable_email")
+		}
+	}
+
+	if d := fraudConfig.Declines; d.Max > 0 && (history.CardDeclines >= d.Max || history.EmailDeclines >= d.Max) {
+		hit(d.Weight, "repeated_declines")
+	}
+
+	switch {
+	case s.Score >= fraudConfig.DenyScore:
+		s.Decision = fraudDecisionDeny
+	case s.Score >= fraudConfig.ReviewScore || unconverted:
+		s.Decision = fraudDecisionReview
+	default:
+		s.Decision = fraudDecisionAllow
+	}
+	return s
+}
+
+// Country of the card's issuer by its six-digit BIN
+func binCountry(bin string) (string, bool) {
+	country, ok := fraudConfig.BINCountry.BINs[bin]
+	return country, ok
+}
+
+// Countries a phone number may belong to, by its longest matching dialing prefix
+func phoneCountries(phone string) []string {
+	prefixes := make([]string, 0, len(fraudConfig.BINCountry.PhonePrefixes))
+	for prefix := range fraudConfig.BINCountry.PhonePrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(phone, prefix) {
+			return fraudConfig.BINCountry.PhonePrefixes[prefix]
+		}
+	}
+	return nil
+}
+
+// Split a comma-separated column, treating "" as an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sportlife/types"
+)
+
+type FraudReview struct {
+	TransactionID    string         `json:"transactionId"`
+	CustomerEmail    string         `json:"customerEmail"`
+	SubscriptionType string         `json:"subscriptionType"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	Status           string         `json:"status"`
+	PaymentTime      time.Time      `json:"paymentTime"`
+	Score            int            `json:"score"`
+	Reasons          []string       `json:"reasons"`
+	ReviewStatus     string         `json:"reviewStatus"`
+}
+
+const (
+	defaultFraudReviewLimit = 50
+	maxFraudReviewLimit     = 200
+)
+
+// How long a payment flagged for review is held before it is declined. FRAUD_REVIEW_HOLD_TIMEOUT
+// overrides it.
+var fraudHoldTimeout = envDuration("FRAUD_REVIEW_HOLD_TIMEOUT", 24*time.Hour)
+
+// Payments flagged for review are held uncharged until an admin approves them. They are stored with
+// their card tokenized, so any instance can charge an approved one, and this loop declines the ones
+// left undecided for longer than fraudHoldTimeout. FRAUD_HOLD_EXPIRY_INTERVAL sets how often it looks.
+func startFraudHoldExpiry() {
+	interval := envDuration("FRAUD_HOLD_EXPIRY_INTERVAL", time.Minute)
+	goBackground(func(stop context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-ticker.C:
+				expireFraudHolds(stop)
+			}
+		}
+	})
+	log.Printf("Started fraud hold expiry checking every %s", interval)
+}
+
+// Decline the held payments whose review has run out of time. Instances doing this at the same time
+// are safe: only one of them gets to move each payment out of OnHold.
+func expireFraudHolds(ctx context.Context) {
+	ids, err := listExpiredFraudHolds(ctx, time.Now().Add(-fraudHoldTimeout))
+	if err != nil {
+		logFrom(ctx).Error("Error listing expired fraud holds", "error", err)
+		return
+	}
+	for _, id := range ids {
+		job, err := getPaymentJob(ctx, id)
+		if err != nil {
+			logFrom(ctx).Error("Error loading held payment", "transaction_id", id, "error", err)
+			continue
+		}
+		declineParkedPayment(ctx, job, "Payment review timed out")
+	}
+}
+
+func handleListFraudReviews(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = fraudReviewPending
+	}
+	limit := defaultFraudReviewLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxFraudReviewLimit {
+			writeError(w, r, types.ErrCodeValidationFailed, "Invalid limit",
+				types.FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxFraudReviewLimit)})
+			return
+		}
+		limit = n
+	}
+
+	reviews, err := listFraudReviews(r.Context(), status, limit)
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing fraud reviews", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading fraud reviews")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reviews": reviews})
+}
+
+// Approve a flagged payment, charging it now if it was held for the review
+func handleApproveFraudReview(w http.ResponseWriter, r *http.Request) {
+	review, ok := loadPendingFraudReview(w, r)
+	if !ok {
+		return
+	}
+	if review.Status != paymentStatusOnHold {
+		if closeFraudReview(w, r, review.TransactionID, fraudReviewApproved) {
+			writeFraudReview(w, r, review.TransactionID)
+		}
+		return
+	}
+
+	// Any instance can charge the payment: it is loaded from what was stored when it was held
+	job, err := getPaymentJob(r.Context(), review.TransactionID)
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading held payment", "transaction_id", review.TransactionID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading held payment")
+		return
+	}
+	job.RequestID = requestID(r)
+	if !closeFraudReview(w, r, review.TransactionID, fraudReviewApproved) {
+		return
+	}
+	// Approved payments have waited long enough, so they are charged right away instead of queueing
+	payments.publish(PaymentStatus{TransactionID: job.TransactionID, Status: paymentStatusPending, Stage: stageQueued})
+	goBackground(func(context.Context) {
+		runPaymentJob(job)
+	})
+	logFrom(r.Context()).Info("Fraud review approved, charging held payment", "transaction_id", review.TransactionID)
+	writeFraudReview(w, r, review.TransactionID)
+}
+
+// Reject a flagged payment: a held one is declined without being charged, a captured one refunded
+// for whatever is left of it. The refund is reserved with the decision; see rejectFraudReview.
+func handleRejectFraudReview(w http.ResponseWriter, r *http.Request) {
+	review, ok := loadPendingFraudReview(w, r)
+	if !ok {
+		return
+	}
+	// A payment still in the worker queue cannot be refunded yet
+	if review.Status == paymentStatusPending || review.Status == paymentStatusProcessing || review.Status == paymentStatusAuthenticationRequired {
+		writeError(w, r, types.ErrCodeConflict, "Payment is still being processed, retry once it completes")
+		return
+	}
+	held := review.Status == paymentStatusOnHold
+	refund, decided, err := rejectFraudReview(r.Context(), review.TransactionID, userID(r.Context()), "Rejected in fraud review")
+	switch {
+	case errors.Is(err, errPaymentInProgress):
+		writeError(w, r, types.ErrCodeConflict, "Payment is still being processed, retry once it completes")
+		return
+	case errors.Is(err, errGatewayRefundFailed):
+		logFrom(r.Context()).Error("Gateway refused refund of rejected payment", "transaction_id", review.TransactionID, "error", err)
+		writeError(w, r, types.ErrCodeUpstreamUnavailable, "Review rejected but the refund could not be completed, refund the payment again")
+		return
+	case err != nil:
+		logFrom(r.Context()).Error("Error rejecting fraud review", "transaction_id", review.TransactionID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error updating fraud review")
+		return
+	case !decided:
+		writeError(w, r, types.ErrCodeConflict, "Fraud review has already been decided")
+		return
+	}
+
+	if held {
+		recordPayment("declined", review.SubscriptionType, review.Amount)
+		payments.publish(PaymentStatus{TransactionID: review.TransactionID, Status: paymentStatusDeclined, Stage: stageCompleted, Message: "Payment was declined"})
+	}
+	logFrom(r.Context()).Info("Fraud review rejected", "transaction_id", review.TransactionID, "refunded", refund != nil)
+	writeFraudReview(w, r, review.TransactionID)
+}
+
+func loadPendingFraudReview(w http.ResponseWriter, r *http.Request) (*FraudReview, bool) {
+	review, err := getFraudReview(r.Context(), r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Fraud review not found")
+		return nil, false
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading fraud review", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading fraud review")
+		return nil, false
+	}
+	if review.ReviewStatus != fraudReviewPending {
+		writeError(w, r, types.ErrCodeConflict, "Fraud review has already been "+review.ReviewStatus)
+		return nil, false
+	}
+	return review, true
+}
+
+func closeFraudReview(w http.ResponseWriter, r *http.Request, transactionID, reviewStatus string) bool {
+	ok, err := resolveFraudReview(r.Context(), transactionID, reviewStatus, userID(r.Context()))
+	if err != nil {
+		logFrom(r.Context()).Error("Error updating fraud review", "transaction_id", transactionID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error updating fraud review")
+		return false
+	}
+	if !ok {
+		writeError(w, r, types.ErrCodeConflict, "Fraud review has already been decided")
+		return false
+	}
+	return true
+}
+
+func writeFraudReview(w http.ResponseWriter, r *http.Request, transactionID string) {
+	review, err := getFraudReview(r.Context(), transactionID)
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading fraud review", "transaction_id", transactionID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading fraud review")
+		return
+	}
+	writeJSON(w, http.StatusOK, review)
+}
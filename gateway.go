@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"sportlife/types"
+)
+
+type chargeRequest struct {
+	TransactionID string
+	Amount        types.Money
+	// Either the card number or the token of a saved card
+	CardNumber string
+	CardToken  string
+	Email      string
+	// Merchant-initiated charge of a saved card, with no cardholder around for 3-D Secure
+	OffSession bool
+	// Where the challenge page sends the cardholder back to once they have authenticated
+	ReturnURL string
+}
+
+type chargeResult struct {
+	Approved      bool
+	DeclineReason string
+	// Set when the issuer wants the cardholder to authenticate before the charge goes through
+	Challenge *challenge
+}
+
+// A 3-D Secure challenge the cardholder has to complete in their browser
+type challenge struct {
+	AuthenticationID string
+	URL              string
+}
+
+// paymentGateway charges a card with the acquirer
+type paymentGateway interface {
+	Charge(ctx context.Context, req chargeRequest) (chargeResult, error)
+	// Finish a charge after its challenge, given the response the challenge page posted back
+	CompleteChallenge(ctx context.Context, authenticationID, response string) (chargeResult, error)
+	// Store a card with the acquirer and return the token later charges can use instead of its number
+	Tokenize(ctx context.Context, cardNumber string) (string, error)
+	// Return part or all of a captured charge to the card. Asking again with the same refundID
+	// returns the money once.
+	Refund(ctx context.Context, refundID, transactionID string, amount types.Money) error
+}
+
+// simulatedGateway stands in for a real acquirer. Like most sandbox acquirers it
+// declines cards ending in 0002, asks for 3-D Secure on cards ending in 3220 and
+// approves everything else. Its challenges are answered by threeDSSimulator.
+type simulatedGateway struct {
+	mu         sync.Mutex
+	challenges map[string]*simulatedChallenge
+}
+
+type simulatedChallenge struct {
+	TransactionID string
+	Amount        types.Money
+	ReturnURL     string
+	// Issued by the challenge page once the cardholder enters the right code
+	Response  string
+	ExpiresAt time.Time
+}
+
+const simulatedChallengeTTL = 15 * time.Minute
+
+func newSimulatedGateway() *simulatedGateway {
+	return &simulatedGateway{challenges: make(map[string]*simulatedChallenge)}
+}
+
+func (g *simulatedGateway) Charge(ctx context.Context, req chargeRequest) (chargeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return chargeResult{}, err
+	}
+	card := req.CardNumber
+	if req.CardToken != "" {
+		// Simulated tokens end in the last four digits of their card, which is all the sandbox rules look at
+		if !strings.HasPrefix(req.CardToken, simulatedTokenPrefix) {
+			return chargeResult{DeclineReason: "Unknown card token"}, nil
+		}
+		card = req.CardToken
+	}
+	if strings.HasSuffix(card, "0002") {
+		return chargeResult{DeclineReason: "Card declined by issuer"}, nil
+	}
+	if strings.HasSuffix(card, "3220") {
+		id := randomToken()
+		g.mu.Lock()
+		g.challenges[id] = &simulatedChallenge{
+			TransactionID: req.TransactionID,
+			Amount:        req.Amount,
+			ReturnURL:     req.ReturnURL,
+			ExpiresAt:     time.Now().Add(simulatedChallengeTTL),
+		}
+		g.mu.Unlock()
+		return chargeResult{Challenge: &challenge{AuthenticationID: id, URL: "/v1/3ds-simulator/challenges/" + id}}, nil
+	}
+	return chargeResult{Approved: true}, nil
+}
+
+func (g *simulatedGateway) CompleteChallenge(ctx context.Context, authenticationID, response string) (chargeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return chargeResult{}, err
+	}
+	g.mu.Lock()
+	ch, ok := g.challenges[authenticationID]
+	delete(g.challenges, authenticationID)
+	g.mu.Unlock()
+
+	if !ok || time.Now().After(ch.ExpiresAt) {
+		return chargeResult{DeclineReason: "Authentication session expired"}, nil
+	}
+	if ch.Response == "" || response != ch.Response {
+		return chargeResult{DeclineReason: "Cardholder authentication failed"}, nil
+	}
+	return chargeResult{Approved: true}, nil
+}
+
+const simulatedTokenPrefix = "sim_"
+
+func (g *simulatedGateway) Tokenize(ctx context.Context, cardNumber string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return simulatedTokenPrefix + randomToken() + "_" + cardNumber[len(cardNumber)-4:], nil
+}
+
+// The sandbox accepts every refund, the service has already checked it against the charge
+func (g *simulatedGateway) Refund(ctx context.Context, refundID, transactionID string, amount types.Money) error {
+	return ctx.Err()
+}
+
+// Look up an open challenge for the simulator's challenge page
+func (g *simulatedGateway) challenge(authenticationID string) (simulatedChallenge, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ch, ok := g.challenges[authenticationID]
+	if !ok || time.Now().After(ch.ExpiresAt) {
+		return simulatedChallenge{}, false
+	}
+	return *ch, true
+}
+
+// Record the cardholder's answer and return the response to post back to the merchant
+func (g *simulatedGateway) answerChallenge(authenticationID string, authenticated bool) (simulatedChallenge, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ch, ok := g.challenges[authenticationID]
+	if !ok || time.Now().After(ch.ExpiresAt) {
+		return simulatedChallenge{}, false
+	}
+	if authenticated {
+		ch.Response = randomToken()
+	} else {
+		ch.Response = ""
+	}
+	return *ch, true
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var gateway paymentGateway = newSimulatedGateway()
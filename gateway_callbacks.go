@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"sportlife/client"
+	"sportlife/types"
+)
+
+// What an acquirer can tell us about a payment after the fact
+const (
+	gatewayEventCaptured = "captured"
+	gatewayEventFailed   = "failed"
+	gatewayEventReversed = "reversed"
+)
+
+// Outcomes recorded for every callback received
+const (
+	callbackOutcomeApplied            = "applied"
+	callbackOutcomeDuplicate          = "duplicate"
+	callbackOutcomeUnknownTransaction = "unknown_transaction"
+	callbackOutcomeInvalidTransition  = "invalid_transition"
+	callbackOutcomeAmountMismatch     = "amount_mismatch"
+	callbackOutcomeUnsupported        = "unsupported_event"
+)
+
+const (
+	maxCallbackBody            = 1 << 20
+	callbackSignatureTolerance = 5 * time.Minute
+	// A callback can overtake the insert of its payment; the provider is asked to retry after this long
+	unknownTransactionRetryAfter = 30 * time.Second
+)
+
+// A provider's callback reduced to what the payment service acts on
+type gatewayEvent struct {
+	EventID       string
+	Kind          string
+	TransactionID string
+	// Nil when the provider did not send an amount
+	Amount *types.Money
+	// Empty when the provider did not say which currency Amount is in
+	Currency types.Currency
+}
+
+// What applying a callback did to its payment
+type gatewayEventResult struct {
+	Outcome          string
+	PreviousStatus   string
+	Status           string
+	SubscriptionType string
+	Amount           types.Money
+}
+
+// callbackProvider authenticates and decodes one acquirer's callbacks
+type callbackProvider interface {
+	Verify(header http.Header, body []byte) error
+	Parse(body []byte) (gatewayEvent, error)
+}
+
+// Providers by the {provider} path segment of /gateway/callbacks/{provider}
+var callbackProviders = map[string]callbackProvider{
+	"sandbox": sandboxCallbackProvider{secret: os.Getenv("GATEWAY_SANDBOX_CALLBACK_SECRET")},
+}
+
+// sandboxCallbackProvider speaks the format produced by cmd/gateway-signer: a JSON event signed
+// like our own outbound webhooks, in X-Sandbox-Signature
+type sandboxCallbackProvider struct {
+	secret string
+}
+
+const sandboxSignatureHeader = "X-Sandbox-Signature"
+
+type sandboxCallback struct {
+	ID            string         `json:"id"`
+	Type          string         `json:"type"`
+	TransactionID string         `json:"transactionId"`
+	Amount        *types.Money   `json:"amount"`
+	Currency      types.Currency `json:"currency"`
+}
+
+func (p sandboxCallbackProvider) Verify(header http.Header, body []byte) error {
+	if p.secret == "" {
+		return errors.New("GATEWAY_SANDBOX_CALLBACK_SECRET is not set")
+	}
+	return client.VerifySignature(p.secret, header.Get(sandboxSignatureHeader), body, callbackSignatureTolerance)
+}
+
+func (sandboxCallbackProvider) Parse(body []byte) (gatewayEvent, error) {
+	var cb sandboxCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		return gatewayEvent{}, err
+	}
+	if cb.ID == "" || cb.TransactionID == "" {
+		return gatewayEvent{}, errors.New("id and transactionId are required")
+	}
+	kinds := map[string]string{
+		"payment.captured": gatewayEventCaptured,
+		"payment.failed":   gatewayEventFailed,
+		"payment.reversed": gatewayEventReversed,
+	}
+	return gatewayEvent{EventID: cb.ID, Kind: kinds[cb.Type], TransactionID: cb.TransactionID, Amount: cb.Amount, Currency: cb.Currency}, nil
+}
+
+// Status a payment moves to for an event, and the statuses it may move from
+var gatewayTransitions = map[string]struct {
+	To   string
+	From []string
+}{
+	gatewayEventCaptured: {paymentStatusSuccess, []string{paymentStatusPending, paymentStatusProcessing, paymentStatusAuthenticationRequired}},
+	gatewayEventFailed:   {paymentStatusFailed, []string{paymentStatusPending, paymentStatusProcessing, paymentStatusAuthenticationRequired}},
+	gatewayEventReversed: {paymentStatusReversed, []string{paymentStatusSuccess}},
+}
+
+// Decide what an event does to a payment currently in status with the given amount, of which
+// refunded has been refunded already. A reversal may take back part of the payment, up to what
+// was not refunded; any other event has to name the full amount.
+func gatewayTransition(ev gatewayEvent, status string, amount, refunded types.Money) (string, string) {
+	t, ok := gatewayTransitions[ev.Kind]
+	if !ok {
+		return "", callbackOutcomeUnsupported
+	}
+	if ev.Amount != nil {
+		fits := sameAmount(ev, amount)
+		if ev.Kind == gatewayEventReversed {
+			left, err := amount.Sub(refunded)
+			fits = err == nil && withinAmount(ev, left)
+		}
+		if !fits {
+			return "", callbackOutcomeAmountMismatch
+		}
+	}
+	if !contains(t.From, status) {
+		return "", callbackOutcomeInvalidTransition
+	}
+	return t.To, callbackOutcomeApplied
+}
+
+// Check the amount of an event against the payment's. An event without a currency is taken to be
+// in the payment's currency.
+func sameAmount(ev gatewayEvent, amount types.Money) bool {
+	if ev.Currency != "" && ev.Currency != amount.Currency() {
+		return false
+	}
+	sent, err := ev.Amount.WithCurrency(amount.Currency())
+	return err == nil && sent.Equal(amount)
+}
+
+// Check that an event moves some money, but no more than limit, in the payment's currency
+func withinAmount(ev gatewayEvent, limit types.Money) bool {
+	if ev.Currency != "" && ev.Currency != limit.Currency() {
+		return false
+	}
+	sent, err := ev.Amount.WithCurrency(limit.Currency())
+	if err != nil || !sent.IsPositive() {
+		return false
+	}
+	c, err := sent.Cmp(limit)
+	return err == nil && c <= 0
+}
+
+// Receive an asynchronous payment update from an acquirer. Anything that passes the signature
+// check is stored verbatim and acknowledged with 200, even when it changes nothing, so the
+// provider stops retrying; the recorded outcome says what happened. The exception is a callback
+// for a payment not stored yet, which is answered 409 without being recorded so that it is retried.
+func handleGatewayCallback(w http.ResponseWriter, r *http.Request) {
+	providerName := r.PathValue("provider")
+	provider, ok := callbackProviders[providerName]
+	if !ok {
+		writeError(w, r, types.ErrCodeNotFound, "Unknown gateway provider")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBody))
+	if err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if err := provider.Verify(r.Header, body); err != nil {
+		logFrom(r.Context()).Warn("Rejected gateway callback", "provider", providerName, "error", err)
+		gatewayCallbacksTotal.WithLabelValues(providerName, "invalid_signature").Inc()
+		writeError(w, r, types.ErrCodeUnauthorized, "Invalid callback signature")
+		return
+	}
+	ev, err := provider.Parse(body)
+	if err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid callback payload: "+err.Error())
+		return
+	}
+
+	result, err := applyGatewayEvent(r.Context(), providerName, ev, body)
+	if err != nil {
+		logFrom(r.Context()).Error("Error applying gateway callback", "provider", providerName, "event_id", ev.EventID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error saving gateway callback")
+		return
+	}
+	gatewayCallbacksTotal.WithLabelValues(providerName, result.Outcome).Inc()
+
+	logger := logFrom(r.Context()).With("provider", providerName, "event_id", ev.EventID, "transaction_id", ev.TransactionID)
+	if result.Outcome == callbackOutcomeUnknownTransaction {
+		logger.Warn("Gateway callback for an unknown payment, asking the provider to retry")
+		w.Header().Set("Retry-After", strconv.Itoa(int(unknownTransactionRetryAfter.Seconds())))
+		writeError(w, r, types.ErrCodeConflict, "Payment is not known yet, retry later")
+		return
+	}
+	if result.Outcome == callbackOutcomeApplied {
+		logger.Info("Payment updated by gateway callback", "from", result.PreviousStatus, "to", result.Status)
+		if err := settleCartTransaction(r.Context(), ev.TransactionID, result.Status); err != nil {
+			logger.Error("Error settling cart transaction", "status", result.Status, "error", err)
+		}
+		recordPayment(metricStatus(result.Status), result.SubscriptionType, result.Amount)
+		if result.Status == paymentStatusSuccess {
+			// The worker lost the race with this payment, so it is completed from here
+			goBackground(func(context.Context) { completeStoredPayment(logger, ev.TransactionID) })
+		} else {
+			payments.publish(PaymentStatus{TransactionID: ev.TransactionID, Status: result.Status, Stage: stageCompleted})
+		}
+	} else {
+		logger.Info("Gateway callback not applied", "outcome", result.Outcome)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"received": true,
+		"outcome":  result.Outcome,
+	})
+}
+
+// Complete a payment captured by a callback from what was stored when it was accepted
+func completeStoredPayment(logger *slog.Logger, transactionID string) {
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), logger), paymentJobTimeout)
+	defer cancel()
+	job, err := getPaymentJob(ctx, transactionID)
+	if err != nil {
+		logger.Error("Error loading payment for receipt", "error", err)
+		payments.publish(PaymentStatus{TransactionID: transactionID, Status: paymentStatusSuccess, Stage: stageCompleted, Message: "Receipt could not be generated"})
+		return
+	}
+	completePayment(ctx, job)
+}
+
+// Label used for a payment status in payments_total
+func metricStatus(status string) string {
+	switch status {
+	case paymentStatusSuccess:
+		return "success"
+	case paymentStatusDeclined:
+		return "declined"
+	case paymentStatusReversed:
+		return "reversed"
+	default:
+		return "failed"
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Liveness: the process is up and serving HTTP
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Readiness: every dependency needed to take a payment is usable.
+// The SMTP check is opt-in through READYZ_CHECK_SMTP=true since mail outages should not take us out of rotation.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := []readinessCheck{
+		{"database", checkDatabase},
+		{"receipts_storage", checkReceiptsStorage},
+		{"fonts", checkFonts},
+	}
+	if smtpCheck, _ := strconv.ParseBool(os.Getenv("READYZ_CHECK_SMTP")); smtpCheck {
+		checks = append(checks, readinessCheck{"smtp", checkSMTP})
+	}
+
+	resp := healthResponse{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+	status := http.StatusOK
+	if shuttingDown.Load() {
+		resp.Status = "shutting_down"
+		status = http.StatusServiceUnavailable
+	}
+
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+		start := time.Now()
+		err := c.check(ctx)
+		cancel()
+
+		result := checkResult{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			result.Status = "fail"
+			result.Error = err.Error()
+			status = http.StatusServiceUnavailable
+			if resp.Status == "ok" {
+				resp.Status = "unavailable"
+			}
+		}
+		resp.Checks[c.name] = result
+	}
+
+	writeJSON(w, status, resp)
+}
+
+func checkDatabase(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+// Make sure a receipt could actually be written right now
+func checkReceiptsStorage(ctx context.Context) error {
+	if err := os.MkdirAll(receiptsDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(receiptsDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Parse the receipt fonts the same way generateReceipt does
+func checkFonts(ctx context.Context) error {
+	return newReceiptPDF().Error()
+}
+
+func checkSMTP(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", smtpHost, smtpPort))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	serverReadTimeout       = 15 * time.Second
+	serverReadHeaderTimeout = 5 * time.Second
+	serverWriteTimeout      = 60 * time.Second // SSE streams lift this per request
+	serverIdleTimeout       = 120 * time.Second
+	shutdownTimeout         = 30 * time.Second
+	// How long /readyz fails before the listener closes, so load balancers notice first
+	defaultShutdownDrainPeriod = 5 * time.Second
+)
+
+var (
+	// Tracks background goroutines (payment workers, schedulers) that must finish before exit
+	backgroundWork sync.WaitGroup
+	// Cancelled when shutdown starts so background loops stop picking up new work
+	stopping, stopBackground = context.WithCancel(context.Background())
+	// Set as soon as shutdown starts; /readyz reports not ready from then on
+	shuttingDown atomic.Bool
+	// Flushers (tracing, ...) run after background work and before the DB pool is closed
+	shutdownHooks []func(ctx context.Context) error
+)
+
+// Register fn to run during shutdown
+func onShutdown(fn func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// Run fn in the background and keep the process alive until it returns.
+// fn receives a context that is cancelled once shutdown begins.
+func goBackground(fn func(ctx context.Context)) {
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		fn(stopping)
+	}()
+}
+
+// Stop accepting requests, drain in-flight handlers, wait for background work and close the DB pool
+func shutdown(srv *http.Server) {
+	// Fail readiness first and keep serving until the orchestrator has stopped routing new traffic here
+	shuttingDown.Store(true)
+	drain := envDuration("SHUTDOWN_DRAIN_PERIOD", defaultShutdownDrainPeriod)
+	log.Printf("Shutting down: waiting %s for load balancers to stop sending traffic", drain)
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	log.Println("Shutting down: draining in-flight requests")
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error draining HTTP server: %v", err)
+	}
+
+	log.Println("Shutting down: waiting for background work")
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Shutdown deadline exceeded, abandoning unfinished background work")
+	}
+
+	for _, hook := range shutdownHooks {
+		if err := hook(ctx); err != nil {
+			log.Printf("Error running shutdown hook: %v", err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+	log.Println("Payment service stopped")
+}
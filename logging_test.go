@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestRedactString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"payment for ivan@mail.ru", "payment for i***@mail.ru"},
+		{"card 4111111111111111 declined", "card ************1111 declined"},
+		{"call +77011234567", "call +*******4567"},
+		{"call 87011234567 now", "call *******4567 now"},
+		{"call +7 (701) 123-45-67", "call +* (***) ***-45-67"},
+		{"call 8 701 123 45 67", "call * *** *** 45 67"},
+		{"call +998 90 123 45 67", "call +*** ** *** 45 67"},
+		{"amount 12500.00 KZT", "amount 12500.00 KZT"},
+		{"order 701123", "order 701123"},
+	}
+	for _, tt := range tests {
+		if got := redactString(tt.in); got != tt.want {
+			t.Errorf("redactString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactAttrKeys(t *testing.T) {
+	tests := []struct {
+		attr slog.Attr
+		want string
+	}{
+		{slog.String("customer_name", "Ivan Petrov"), "[redacted]"},
+		{slog.String("phone", "+77011234567"), "+*******4567"},
+		{slog.String("email", "ivan@mail.ru"), "i***@mail.ru"},
+		// Only explicit PII keys are blanked, a plan or file name is not
+		{slog.String("name", "Premium"), "Premium"},
+	}
+	for _, tt := range tests {
+		if got := redactAttr(nil, tt.attr).Value.String(); got != tt.want {
+			t.Errorf("redactAttr(%s) = %q, want %q", tt.attr.Key, got, tt.want)
+		}
+	}
+}
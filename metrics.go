@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"sportlife/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Label values must stay bounded: never put emails, card data or transaction IDs in a label.
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "status"})
+
+	paymentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payments_total",
+		Help: "Processed payments by outcome and subscription type.",
+	}, []string{"status", "subscription_type"})
+
+	paymentAmountTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payment_amount_total",
+		Help: "Sum of processed payment amounts by outcome, subscription type and currency.",
+	}, []string{"status", "subscription_type", "currency"})
+
+	receiptGenerationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_service_receipt_generation_duration_seconds",
+		Help:    "Time spent rendering PDF receipts.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	emailsSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_emails_sent_total",
+		Help: "Receipt emails by result.",
+	}, []string{"result"})
+
+	paymentQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_payment_queue_depth",
+		Help: "Payments waiting for a worker.",
+	})
+
+	paymentsRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_payments_rejected_total",
+		Help: "Payments rejected with 503 because the worker queue was full.",
+	})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_rate_limited_total",
+		Help: "Requests rejected with 429 by rate limit rule.",
+	}, []string{"rule"})
+
+	fraudDecisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_fraud_decisions_total",
+		Help: "Fraud screening decisions by outcome.",
+	}, []string{"decision"})
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by resulting delivery status.",
+	}, []string{"status"})
+
+	promoRedemptionsOverLimitTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_promo_redemptions_over_limit_total",
+		Help: "Promo codes charged at a discount that turned out to be past their redemption caps.",
+	})
+
+	gatewayCallbacksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_gateway_callbacks_total",
+		Help: "Inbound gateway callbacks by provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	emailSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_service_email_send_duration_seconds",
+		Help:    "Time spent delivering receipt emails over SMTP.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+)
+
+// Expose database/sql pool stats for the given pool
+func registerDBMetrics(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "payment_service"))
+}
+
+// Record count and latency per route template, never per raw path
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestsTotal.WithLabelValues(route, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+const maxSubscriptionTypeLabels = 20
+
+var (
+	subscriptionTypeLabelsMu sync.Mutex
+	subscriptionTypeLabels   = map[string]bool{}
+)
+
+// Subscription types come from the client, so only the first few distinct values get their own label
+func subscriptionTypeLabel(subscriptionType string) string {
+	subscriptionTypeLabelsMu.Lock()
+	defer subscriptionTypeLabelsMu.Unlock()
+
+	if subscriptionTypeLabels[subscriptionType] {
+		return subscriptionType
+	}
+	if len(subscriptionTypeLabels) >= maxSubscriptionTypeLabels || len(subscriptionType) > 64 {
+		return "other"
+	}
+	subscriptionTypeLabels[subscriptionType] = true
+	return subscriptionType
+}
+
+func recordPayment(status, subscriptionType string, amount types.Money) {
+	label := subscriptionTypeLabel(subscriptionType)
+	paymentsTotal.WithLabelValues(status, label).Inc()
+	paymentAmountTotal.WithLabelValues(status, label, string(amount.Currency())).Add(amount.Float64())
+}
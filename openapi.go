@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"sportlife/types"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+func init() {
+	// HTML pages are checked like plain text so their responses can be validated too
+	openapi3filter.RegisterBodyDecoder("text/html", openapi3filter.PlainBodyDecoder)
+}
+
+// Serve the OpenAPI document describing every endpoint
+func serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// Load and check the embedded OpenAPI document
+func loadOpenAPIRouter() (routers.Router, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(openapi3.NewLoader().Context); err != nil {
+		return nil, err
+	}
+	return gorillamux.NewRouter(doc)
+}
+
+// Response validation is only enabled when APP_ENV=test so contract drift fails loudly in tests
+func responseValidationEnabled() bool {
+	return os.Getenv("APP_ENV") == "test"
+}
+
+// Middleware that validates requests (and, in test mode, responses) against the OpenAPI document.
+// Routes that are not described in the document are passed through untouched.
+func openAPIValidator(next http.Handler) http.Handler {
+	router, err := loadOpenAPIRouter()
+	if err != nil {
+		log.Fatalf("Invalid OpenAPI document: %v", err)
+	}
+	validateResponses := responseValidationEnabled()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    &openapi3filter.Options{MultiError: true},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			writeError(w, r, types.ErrCodeValidationFailed, "Request does not match the API contract", openAPIFieldErrors(err, "")...)
+			return
+		}
+
+		// Event streams are passed straight through: buffering them would hold back every event
+		// until the stream ends, and they have no schema to check the body against
+		if !validateResponses || streamsEvents(route.Operation) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		respInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 rec.status,
+			Header:                 rec.Header(),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		}
+		respInput.SetBodyBytes(rec.body.Bytes())
+		if err := openapi3filter.ValidateResponse(r.Context(), respInput); err != nil {
+			logFrom(r.Context()).Error("Response does not match the API contract", "method", r.Method, "path", r.URL.Path, "error", err)
+			writeError(w, r, types.ErrCodeInternal, "Response does not match the API contract: "+err.Error())
+			return
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// Whether the operation answers with a text/event-stream
+func streamsEvents(op *openapi3.Operation) bool {
+	if op == nil || op.Responses == nil {
+		return false
+	}
+	for _, resp := range op.Responses.Map() {
+		if resp.Value != nil && resp.Value.Content["text/event-stream"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Buffers a handler's response so it can be validated before it is sent
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+// Flush is a no-op: nothing leaves the recorder until validation is done
+func (rec *responseRecorder) Flush() {}
+
+// Flatten kin-openapi validation errors into the field errors of our envelope
+func openAPIFieldErrors(err error, field string) []types.FieldError {
+	var multi openapi3.MultiError
+	if errors.As(err, &multi) {
+		var fields []types.FieldError
+		for _, e := range multi {
+			fields = append(fields, openAPIFieldErrors(e, field)...)
+		}
+		return fields
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) {
+		if reqErr.Parameter != nil {
+			field = reqErr.Parameter.Name
+		}
+		if reqErr.Err != nil {
+			return openAPIFieldErrors(reqErr.Err, field)
+		}
+		return []types.FieldError{{Field: field, Message: reqErr.Reason}}
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		if pointer := schemaErr.JSONPointer(); len(pointer) > 0 {
+			field = strings.Join(pointer, ".")
+		}
+		return []types.FieldError{{Field: field, Message: schemaErr.Reason}}
+	}
+
+	return []types.FieldError{{Field: field, Message: err.Error()}}
+}
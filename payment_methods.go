@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+// A card a customer saved for later payments. Only the acquirer's token is kept, never the number.
+type PaymentMethod struct {
+	ID        int64     `json:"id"`
+	Brand     string    `json:"brand"`
+	LastFour  string    `json:"lastFour"`
+	ExpMonth  int       `json:"expMonth"`
+	ExpYear   int       `json:"expYear"`
+	IsDefault bool      `json:"isDefault"`
+	CreatedAt time.Time `json:"createdAt"`
+	Token     string    `json:"-"`
+	// Fingerprint and BIN of the card, for fraud screening of payments made with it
+	Fingerprint string `json:"-"`
+	BIN         string `json:"-"`
+}
+
+// Card brands by the number prefixes they issue, most specific first
+var cardBrands = []struct {
+	brand    string
+	from, to int
+	digits   int
+}{
+	{"mir", 2200, 2204, 4},
+	{"mastercard", 2221, 2720, 4},
+	{"mastercard", 51, 55, 2},
+	{"amex", 34, 34, 2},
+	{"amex", 37, 37, 2},
+	{"unionpay", 62, 62, 2},
+	{"visa", 4, 4, 1},
+}
+
+func cardBrand(cardNumber string) string {
+	for _, b := range cardBrands {
+		if len(cardNumber) < b.digits {
+			continue
+		}
+		prefix, err := strconv.Atoi(cardNumber[:b.digits])
+		if err == nil && prefix >= b.from && prefix <= b.to {
+			return b.brand
+		}
+	}
+	return "unknown"
+}
+
+// Parse a card expiry written as MM/YY
+func parseCardExpiry(expiry string) (month, year int, err error) {
+	mm, yy, ok := strings.Cut(strings.TrimSpace(expiry), "/")
+	if !ok || len(mm) != 2 || len(yy) != 2 {
+		return 0, 0, errors.New("must be in the format MM/YY")
+	}
+	month, err = strconv.Atoi(mm)
+	if err != nil || month < 1 || month > 12 {
+		return 0, 0, errors.New("must be in the format MM/YY")
+	}
+	year, err = strconv.Atoi(yy)
+	if err != nil {
+		return 0, 0, errors.New("must be in the format MM/YY")
+	}
+	return month, 2000 + year, nil
+}
+
+// A card can be charged until the end of its expiry month
+func cardExpired(month, year int, now time.Time) bool {
+	return year*12+month < now.Year()*12+int(now.Month())
+}
+
+// Last four digits, fingerprint and BIN of the card a payment is made with, typed in or saved
+func (d PaymentData) card() (lastFour, fingerprint, bin string) {
+	if d.SavedMethod != nil {
+		return d.SavedMethod.LastFour, d.SavedMethod.Fingerprint, d.SavedMethod.BIN
+	}
+	return d.CardNumber[len(d.CardNumber)-4:], cardFingerprint(d.CardNumber), d.CardNumber[:6]
+}
+
+// Resolve the saved card a payment is made with. Saved cards can only be used by their owner,
+// so the caller must be logged in as the customer the card belongs to.
+func applySavedPaymentMethod(w http.ResponseWriter, r *http.Request, data *PaymentData) bool {
+	if userID(r.Context()) == "" {
+		writeError(w, r, types.ErrCodeUnauthorized, "Log in to pay with a saved card")
+		return false
+	}
+	customer, ok := loadCurrentCustomer(w, r)
+	if !ok {
+		return false
+	}
+	method, err := getPaymentMethod(r.Context(), customer.ID, data.PaymentMethodID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid payment data",
+			types.FieldError{Field: "paymentMethodId", Message: "is not one of your saved cards"})
+		return false
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading payment method", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment method")
+		return false
+	}
+	if cardExpired(method.ExpMonth, method.ExpYear, time.Now()) {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid payment data",
+			types.FieldError{Field: "paymentMethodId", Message: "card has expired"})
+		return false
+	}
+	data.SavedMethod = method
+	data.CustomerID = customer.ID
+	data.SaveCard = false
+	return true
+}
+
+// Cards are saved to the logged-in caller's customer account. A caller without one yet gets the
+// account of their login email, so their first payment has to be made with it.
+func checkSaveCardOwner(w http.ResponseWriter, r *http.Request, data *PaymentData) bool {
+	if userID(r.Context()) == "" {
+		writeError(w, r, types.ErrCodeUnauthorized, "Log in to save a card")
+		return false
+	}
+	customer, err := getCustomerForUser(r.Context(), userID(r.Context()), userEmail(r.Context()))
+	if err == nil {
+		data.CustomerID = customer.ID
+		return true
+	}
+	if err != sql.ErrNoRows {
+		logFrom(r.Context()).Error("Error loading customer", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading customer")
+		return false
+	}
+	if normalizeEmail(data.Email) != normalizeEmail(userEmail(r.Context())) {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid payment data",
+			types.FieldError{Field: "email", Message: "must be your account's email to save the card"})
+		return false
+	}
+	return true
+}
+
+// Tokenize and save the card of a successful payment the customer asked us to remember. The first
+// card a customer saves becomes their default.
+func savePaymentCard(ctx context.Context, data PaymentData) error {
+	month, year, err := parseCardExpiry(data.CardExpiry)
+	if err != nil {
+		return fmt.Errorf("card expiry: %w", err)
+	}
+	card := data.TokenizedCard
+	if card == nil {
+		if card, err = tokenizePaymentCard(ctx, data); err != nil {
+			return err
+		}
+	}
+	method := *card
+	method.ExpMonth, method.ExpYear = month, year
+	return insertPaymentMethod(ctx, data.CustomerID, method)
+}
+
+// Tokenize the card a payment is made with. A saved card already is.
+func tokenizePaymentCard(ctx context.Context, data PaymentData) (*PaymentMethod, error) {
+	if data.SavedMethod != nil {
+		return data.SavedMethod, nil
+	}
+	token, err := gateway.Tokenize(ctx, data.CardNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentMethod{
+		Brand:       cardBrand(data.CardNumber),
+		LastFour:    data.CardNumber[len(data.CardNumber)-4:],
+		Token:       token,
+		Fingerprint: cardFingerprint(data.CardNumber),
+		BIN:         data.CardNumber[:6],
+	}, nil
+}
+
+func handleListMyPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	customer, ok := loadCurrentCustomer(w, r)
+	if !ok {
+		return
+	}
+	methods, err := listPaymentMethods(r.Context(), customer.ID)
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing payment methods", "customer_id", customer.ID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment methods")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"paymentMethods": methods})
+}
+
+// Forget a saved card; when it was the default, the most recently saved remaining card takes over
+func handleDeleteMyPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	customer, ok := loadCurrentCustomer(w, r)
+	if !ok {
+		return
+	}
+	err := deletePaymentMethod(r.Context(), customer.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Payment method not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error deleting payment method", "payment_method_id", id, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error deleting payment method")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Make a saved card the one renewals are charged to
+func handleSetDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	customer, ok := loadCurrentCustomer(w, r)
+	if !ok {
+		return
+	}
+	err := setDefaultPaymentMethod(r.Context(), customer.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Payment method not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error setting default payment method", "payment_method_id", id, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error updating payment method")
+		return
+	}
+	handleListMyPaymentMethods(w, r)
+}
+
+type RenewalRequest struct {
+	SubscriptionType string         `json:"subscriptionType"`
+	Currency         types.Currency `json:"currency,omitempty"`
+	// First day of the period paid for, YYYY-MM-DD; today when not sent
+	PeriodStart string `json:"periodStart,omitempty"`
+}
+
+// Charge a customer's default card for the next period of their subscription, at the plan's
+// current price. The renewal scheduler does the same for subscriptions that are due.
+func handleRenewSubscription(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	var req RenewalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+	var fields []types.FieldError
+	if req.SubscriptionType == "" {
+		fields = append(fields, types.FieldError{Field: "subscriptionType", Message: "is required"})
+	}
+	if req.Currency == "" {
+		req.Currency = baseCurrency
+	}
+	if !isPaymentCurrency(req.Currency) {
+		fields = append(fields, types.FieldError{Field: "currency", Message: "must be one of " + paymentCurrencyList()})
+	}
+	periodStart := time.Now().UTC().Truncate(24 * time.Hour)
+	if req.PeriodStart != "" {
+		var err error
+		if periodStart, err = time.Parse(time.DateOnly, req.PeriodStart); err != nil {
+			fields = append(fields, types.FieldError{Field: "periodStart", Message: "must be a date in the format YYYY-MM-DD"})
+		}
+	}
+	if len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid renewal", fields...)
+		return
+	}
+
+	accepted, err := renewSubscription(r.Context(), customerID, req.SubscriptionType, req.Currency, periodStart, requestID(r))
+	if err != nil {
+		writePaymentError(w, r, err)
+		return
+	}
+	writePaymentAccepted(w, accepted.TransactionID, accepted.Status, accepted.StatusToken, accepted.Message)
+}
+
+// Charge a customer's default card for one period of a plan. Each period of a plan is charged at
+// most once: the renewal's transaction ID is reserved for it, and submitting that payment again
+// fails with a conflict. Renewals that cannot be made fail with a *types.APIError saying why.
+func renewSubscription(ctx context.Context, customerID int64, subscriptionType string, currency types.Currency, periodStart time.Time, reqID string) (acceptedPayment, error) {
+	customer, err := getCustomer(ctx, customerID)
+	if err == sql.ErrNoRows {
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeNotFound, Message: "Customer not found"}
+	}
+	if err != nil {
+		logFrom(ctx).Error("Error loading customer", "customer_id", customerID, "error", err)
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeStorageFailed, Message: "Error loading customer"}
+	}
+	method, err := getDefaultPaymentMethod(ctx, customerID)
+	if err == sql.ErrNoRows {
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeValidationFailed, Message: "Customer has no saved card to charge"}
+	}
+	if err != nil {
+		logFrom(ctx).Error("Error loading payment method", "customer_id", customerID, "error", err)
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeStorageFailed, Message: "Error loading payment method"}
+	}
+	if cardExpired(method.ExpMonth, method.ExpYear, time.Now()) {
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeValidationFailed, Message: "Customer's default card has expired"}
+	}
+	price, err := getPlanPrice(ctx, subscriptionType, currency)
+	if err == sql.ErrNoRows {
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeValidationFailed, Message: "Invalid renewal",
+			Fields: []types.FieldError{{Field: "subscriptionType", Message: "has no price in " + string(currency)}}}
+	}
+	if err != nil {
+		logFrom(ctx).Error("Error loading plan price", "error", err)
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeStorageFailed, Message: "Error pricing renewal"}
+	}
+
+	transactionID, err := reserveRenewal(ctx, customerID, subscriptionType, periodStart)
+	if err != nil {
+		logFrom(ctx).Error("Error reserving renewal", "customer_id", customerID, "error", err)
+		return acceptedPayment{}, &types.APIError{Code: types.ErrCodeStorageFailed, Message: "Error saving renewal"}
+	}
+
+	logFrom(ctx).Info("Renewing subscription", "customer_id", customerID, "subscription_type", subscriptionType,
+		"period_start", periodStart.Format(time.DateOnly), "transaction_id", transactionID, "payment_method_id", method.ID)
+	return submitPayment(ctx, PaymentData{
+		TransactionID: transactionID,
+		Email:         customer.Email,
+		Name:          customer.Name,
+		Phone:         customer.Phone,
+		Amount:        price,
+		Currency:      price.Currency(),
+		Locale:        customer.Locale,
+		SavedMethod:   method,
+		CustomerID:    customer.ID,
+		OffSession:    true,
+	}, subscriptionType, reqID)
+}
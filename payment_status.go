@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"sportlife/types"
+)
+
+// Values of payment_transactions.payment_status
+const (
+	paymentStatusPending    = "Pending"
+	paymentStatusProcessing = "Processing"
+	// Waiting for the cardholder to complete a 3-D Secure challenge
+	paymentStatusAuthenticationRequired = "AuthenticationRequired"
+	// Flagged by fraud screening and held uncharged until an admin decides its review
+	paymentStatusOnHold   = "OnHold"
+	paymentStatusSuccess  = "Success"
+	paymentStatusDeclined = "Declined"
+	paymentStatusFailed   = "Failed"
+	paymentStatusRefunded = "Refunded"
+	// The acquirer took the money back after the payment succeeded (chargeback or reversal)
+	paymentStatusReversed = "Reversed"
+)
+
+// Values of payment_refunds.status. A refund is pending from when its amount is reserved until the
+// gateway has answered; only succeeded refunds count as money returned.
+const (
+	refundStatusPending   = "Pending"
+	refundStatusSucceeded = "Succeeded"
+	refundStatusFailed    = "Failed"
+)
+
+// Progress of a payment through the worker, streamed to the checkout page
+const (
+	stageQueued            = "queued"
+	stageCharging          = "charging"
+	stageAuthenticating    = "authenticating"
+	stageUnderReview       = "under_review"
+	stageGeneratingReceipt = "generating_receipt"
+	stageSendingEmail      = "sending_email"
+	stageCompleted         = "completed"
+	stageUnknown           = "unknown"
+)
+
+// How long finished payments stay in the in-memory tracker for late status readers
+const paymentStatusRetention = 10 * time.Minute
+
+const paymentEventsPollInterval = 5 * time.Second
+
+type PaymentStatus struct {
+	TransactionID string `json:"transactionId"`
+	Status        string `json:"status"`
+	Stage         string `json:"stage"`
+	Message       string `json:"message,omitempty"`
+	// Page the cardholder must open while the stage is "authenticating"
+	ChallengeURL string    `json:"challengeUrl,omitempty"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func (s PaymentStatus) finished() bool {
+	return s.Stage == stageCompleted
+}
+
+// Tracks the live status of payments handled by this instance and fans updates out to subscribers
+type paymentTracker struct {
+	mu          sync.Mutex
+	latest      map[string]PaymentStatus
+	subscribers map[string]map[chan PaymentStatus]struct{}
+}
+
+var payments = &paymentTracker{
+	latest:      make(map[string]PaymentStatus),
+	subscribers: make(map[string]map[chan PaymentStatus]struct{}),
+}
+
+func (t *paymentTracker) publish(status PaymentStatus) {
+	status.UpdatedAt = time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.latest[status.TransactionID] = status
+	for ch := range t.subscribers[status.TransactionID] {
+		// Subscribers only care about the newest status, so drop a stale one if they fell behind
+		select {
+		case ch <- status:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- status
+		}
+	}
+
+	if status.finished() {
+		time.AfterFunc(paymentStatusRetention, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.latest[status.TransactionID].UpdatedAt.Equal(status.UpdatedAt) {
+				delete(t.latest, status.TransactionID)
+			}
+		})
+	}
+}
+
+func (t *paymentTracker) subscribe(transactionID string) (<-chan PaymentStatus, func()) {
+	ch := make(chan PaymentStatus, 1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subscribers[transactionID] == nil {
+		t.subscribers[transactionID] = make(map[chan PaymentStatus]struct{})
+	}
+	t.subscribers[transactionID][ch] = struct{}{}
+
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subscribers[transactionID], ch)
+		if len(t.subscribers[transactionID]) == 0 {
+			delete(t.subscribers, transactionID)
+		}
+	}
+}
+
+// Get the live status, falling back to the stored payment when this instance is not tracking it
+func (t *paymentTracker) get(ctx context.Context, transactionID string) (PaymentStatus, error) {
+	t.mu.Lock()
+	status, ok := t.latest[transactionID]
+	t.mu.Unlock()
+	if ok {
+		return status, nil
+	}
+
+	status, err := getStoredPaymentStatus(ctx, transactionID)
+	if err != nil {
+		return PaymentStatus{}, err
+	}
+	status.Stage = stageCompleted
+	switch status.Status {
+	case paymentStatusPending, paymentStatusProcessing:
+		status.Stage = stageUnknown
+	case paymentStatusAuthenticationRequired:
+		status.Stage = stageAuthenticating
+	case paymentStatusOnHold:
+		status.Stage = stageUnderReview
+	}
+	return status, nil
+}
+
+// Random rather than time-based, so the IDs of other payments cannot be guessed
+func newTransactionID() string {
+	return "TRX-" + randomToken()
+}
+
+// A payment's status token is handed to the payer once, with the 202 that accepts the payment, and
+// only its hash is stored
+func hashStatusToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func paymentStatusURL(transactionID, token string) string {
+	return "/v1/payments/" + transactionID + "/status?token=" + url.QueryEscape(token)
+}
+
+func paymentEventsURL(transactionID, token string) string {
+	return "/v1/payments/" + transactionID + "/events?token=" + url.QueryEscape(token)
+}
+
+// Check the token query parameter against the payment's. A wrong token gets the same 404 as an
+// unknown payment so neither reveals which transaction IDs exist.
+func authorizePaymentStatus(w http.ResponseWriter, r *http.Request, transactionID string) bool {
+	hash, err := getStatusTokenHash(r.Context(), transactionID)
+	if err != nil && err != sql.ErrNoRows {
+		logFrom(r.Context()).Error("Error loading payment status token", "transaction_id", transactionID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment status")
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if err == sql.ErrNoRows || hash == "" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(hash), []byte(hashStatusToken(token))) != 1 {
+		writeError(w, r, types.ErrCodeNotFound, "Payment not found")
+		return false
+	}
+	return true
+}
+
+func handleGetPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	if !authorizePaymentStatus(w, r, r.PathValue("id")) {
+		return
+	}
+	status, err := payments.get(r.Context(), r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Payment not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading payment status", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment status")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Stream status updates as Server-Sent Events until the payment finishes or the client goes away
+func handlePaymentEvents(w http.ResponseWriter, r *http.Request) {
+	transactionID := r.PathValue("id")
+	if !authorizePaymentStatus(w, r, transactionID) {
+		return
+	}
+
+	// Subscribe before reading the current status so no update slips in between
+	updates, unsubscribe := payments.subscribe(transactionID)
+	defer unsubscribe()
+
+	status, err := payments.get(r.Context(), transactionID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Payment not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading payment status", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment status")
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(status PaymentStatus) {
+		data, _ := json.Marshal(status)
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	// Payments handled by another instance never publish here, so re-read the stored status periodically
+	ticker := time.NewTicker(paymentEventsPollInterval)
+	defer ticker.Stop()
+
+	send(status)
+	for !status.finished() {
+		select {
+		case <-r.Context().Done():
+			return
+		case status = <-updates:
+			send(status)
+		case <-ticker.C:
+			if latest, err := payments.get(r.Context(), transactionID); err == nil && latest != status {
+				status = latest
+				send(status)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"sportlife/types"
+)
+
+type Payment struct {
+	TransactionID    string         `json:"transactionId"`
+	CustomerEmail    string         `json:"customerEmail"`
+	SubscriptionType string         `json:"subscriptionType"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	// Amount in the reporting currency at the rate of the payment day, when one was known
+	BaseAmount    *types.Money `json:"baseAmount,omitempty"`
+	PaymentMethod string       `json:"paymentMethod"`
+	CardLastFour  string       `json:"cardLastFour"`
+	Status        string       `json:"status"`
+	PaymentTime   time.Time    `json:"paymentTime"`
+	Items         []LineItem   `json:"items,omitempty"`
+	// VAT included in the amount
+	Tax *TaxBreakdown `json:"tax,omitempty"`
+}
+
+type RefundRequest struct {
+	Amount types.Money `json:"amount"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+type Refund struct {
+	RefundID      int64          `json:"refundId"`
+	TransactionID string         `json:"transactionId"`
+	Amount        types.Money    `json:"amount"`
+	Currency      types.Currency `json:"currency"`
+	Reason        string         `json:"reason,omitempty"`
+	CreatedAt     time.Time      `json:"createdAt"`
+}
+
+func handleGetPayment(w http.ResponseWriter, r *http.Request) {
+	payment, err := getPaymentTransaction(r.Context(), r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Payment not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading payment transaction", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment transaction")
+		return
+	}
+	if payment.Items, err = getPaymentLineItems(r.Context(), payment.TransactionID, payment.Currency); err != nil {
+		logFrom(r.Context()).Error("Error loading payment line items", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, payment)
+}
+
+func handleRefundPayment(w http.ResponseWriter, r *http.Request) {
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	payment, err := getPaymentTransaction(r.Context(), r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Payment not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading payment transaction", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading payment transaction")
+		return
+	}
+
+	// Refunds are always in the currency of the payment
+	amount, err := req.Amount.WithCurrency(payment.Currency)
+	if err != nil {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid refund amount",
+			types.FieldError{Field: "amount", Message: "has too many decimal places"})
+		return
+	}
+
+	// Only successful payments can be refunded, and never for more than is left of what was paid
+	if payment.Status != paymentStatusSuccess {
+		writeError(w, r, types.ErrCodeValidationFailed, "Payment cannot be refunded",
+			types.FieldError{Field: "status", Message: "payment is " + payment.Status})
+		return
+	}
+	if cmp, err := amount.Cmp(payment.Amount); err != nil || !amount.IsPositive() || cmp > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid refund amount",
+			types.FieldError{Field: "amount", Message: "must be greater than zero and not exceed the payment amount"})
+		return
+	}
+
+	refund, err := insertRefund(r.Context(), payment.TransactionID, amount, req.Reason)
+	switch {
+	case errors.Is(err, errPaymentNotRefundable):
+		writeError(w, r, types.ErrCodeConflict, "Payment is no longer refundable")
+		return
+	case errors.Is(err, errRefundExceedsPayment):
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid refund amount",
+			types.FieldError{Field: "amount", Message: "exceeds the amount not yet refunded"})
+		return
+	case errors.Is(err, errGatewayRefundFailed):
+		logFrom(r.Context()).Error("Gateway refused refund", "transaction_id", payment.TransactionID, "error", err)
+		writeError(w, r, types.ErrCodeUpstreamUnavailable, "Refund could not be completed")
+		return
+	case err != nil:
+		logFrom(r.Context()).Error("Error inserting refund", "transaction_id", payment.TransactionID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error saving refund")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, refund)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+const (
+	discountTypePercent = "percent"
+	discountTypeFixed   = "fixed"
+)
+
+type PromoCode struct {
+	Code         string `json:"code"`
+	Description  string `json:"description,omitempty"`
+	DiscountType string `json:"discountType"`
+	// Hundredths of a percent for a percentage discount (1050 is 10.5%), minor units of Currency for a fixed one
+	DiscountValue int64 `json:"discountValue"`
+	// Subscription types the code applies to; empty means every plan
+	Plans             []string   `json:"plans"`
+	ValidFrom         time.Time  `json:"validFrom"`
+	ValidUntil        *time.Time `json:"validUntil,omitempty"`
+	MaxRedemptions    *int       `json:"maxRedemptions,omitempty"`
+	MaxPerCustomer    *int       `json:"maxPerCustomer,omitempty"`
+	FirstPurchaseOnly bool       `json:"firstPurchaseOnly"`
+	Redemptions       int        `json:"redemptions"`
+	Active            bool       `json:"active"`
+	// Currency of a fixed discount; percentage discounts apply in any currency
+	Currency types.Currency `json:"currency"`
+}
+
+// A promo code priced into a payment, carried from /init-payment to the receipt
+type AppliedPromo struct {
+	Code     string
+	Subtotal types.Money
+	Discount types.Money
+}
+
+// An initialized payment: what is being bought and what it costs after any promotion
+type paymentIntent struct {
+	TransactionID    string
+	SubscriptionType string
+	BasePrice        types.Money
+	PromoCode        string
+	Discount         types.Money
+	Amount           types.Money
+}
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check the rules of a code that do not depend on who is paying and work out the discount.
+// The returned message explains a rejection to the customer.
+func evaluatePromoCode(promo *PromoCode, subscriptionType string, basePrice types.Money, now time.Time) (types.Money, string) {
+	switch {
+	case !promo.Active || now.Before(promo.ValidFrom):
+		return types.Money{}, "is not valid"
+	case promo.ValidUntil != nil && now.After(*promo.ValidUntil):
+		return types.Money{}, "has expired"
+	case len(promo.Plans) > 0 && !contains(promo.Plans, subscriptionType):
+		return types.Money{}, "does not apply to this plan"
+	case promo.MaxRedemptions != nil && promo.Redemptions >= *promo.MaxRedemptions:
+		return types.Money{}, "has been fully redeemed"
+	case promo.DiscountType == discountTypeFixed && promo.Currency != basePrice.Currency():
+		return types.Money{}, "does not apply to this currency"
+	}
+
+	var discount types.Money
+	if promo.DiscountType == discountTypePercent {
+		discount = basePrice.MulRat(promo.DiscountValue, 10000, types.RoundHalfUp)
+	} else {
+		discount = types.NewMoney(promo.DiscountValue, promo.Currency)
+	}
+	cmp, err := discount.Cmp(basePrice)
+	if err != nil {
+		return types.Money{}, "does not apply to this currency"
+	}
+	if cmp >= 0 {
+		return types.Money{}, "cannot cover the full price"
+	}
+	return discount, ""
+}
+
+// A promo code's redemption caps and how far they have been used, read under the code's lock
+type promoLimits struct {
+	MaxRedemptions      *int
+	MaxPerCustomer      *int
+	Redemptions         int
+	CustomerRedemptions int
+}
+
+// Whether one more redemption stays within the code's caps
+func (l promoLimits) allow() bool {
+	if l.MaxRedemptions != nil && l.Redemptions >= *l.MaxRedemptions {
+		return false
+	}
+	return l.MaxPerCustomer == nil || l.CustomerRedemptions < *l.MaxPerCustomer
+}
+
+// Check the per-customer rules of a code for the customer paying. Concurrent payments can all pass
+// this; redeemPromoCode enforces the caps again under the code's lock once a payment succeeds.
+func checkPromoCustomer(ctx context.Context, promo *PromoCode, email string) (string, error) {
+	if promo.MaxPerCustomer == nil && !promo.FirstPurchaseOnly {
+		return "", nil
+	}
+	redeemed, purchases, err := promoCustomerHistory(ctx, promo.Code, email)
+	if err != nil {
+		return "", err
+	}
+	if promo.MaxPerCustomer != nil && redeemed >= *promo.MaxPerCustomer {
+		return "has already been used", nil
+	}
+	if promo.FirstPurchaseOnly && purchases > 0 {
+		return "is only valid on a first purchase", nil
+	}
+	return "", nil
+}
+
+// Price an /init-payment request in its currency, applying its promo code if it has one. Plans
+// cost what plan_prices says; a plan with no price in the currency is not offered in it.
+func priceInitPayment(ctx context.Context, req InitPaymentRequest) (paymentIntent, []types.FieldError, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = baseCurrency
+	}
+	basePrice, err := getPlanPrice(ctx, req.SubscriptionType, currency)
+	if err == sql.ErrNoRows {
+		return paymentIntent{}, []types.FieldError{{Field: "subscriptionType", Message: "is not offered in " + string(currency)}}, nil
+	}
+	if err != nil {
+		return paymentIntent{}, nil, err
+	}
+
+	intent := paymentIntent{SubscriptionType: req.SubscriptionType, BasePrice: basePrice, Amount: basePrice}
+	code := normalizePromoCode(req.PromoCode)
+	if code == "" {
+		return intent, nil, nil
+	}
+
+	promo, err := getPromoCode(ctx, code)
+	if err == sql.ErrNoRows {
+		return intent, []types.FieldError{{Field: "promoCode", Message: "is not valid"}}, nil
+	}
+	if err != nil {
+		return intent, nil, err
+	}
+	discount, reason := evaluatePromoCode(promo, req.SubscriptionType, basePrice, time.Now())
+	if reason == "" && req.CustomerEmail != "" {
+		if reason, err = checkPromoCustomer(ctx, promo, req.CustomerEmail); err != nil {
+			return intent, nil, err
+		}
+	}
+	if reason != "" {
+		return intent, []types.FieldError{{Field: "promoCode", Message: reason}}, nil
+	}
+
+	intent.PromoCode = promo.Code
+	intent.Discount = discount
+	if intent.Amount, err = basePrice.Sub(discount); err != nil {
+		return intent, nil, err
+	}
+	return intent, nil, nil
+}
+
+// Apply an initialized payment to the customer's payment data: the server's price wins over the
+// amount the page sent, and the promo code is checked again now that we know who is paying.
+func applyPaymentIntent(ctx context.Context, intent *paymentIntent, data *PaymentData) ([]types.FieldError, error) {
+	data.Amount = intent.Amount
+	data.Currency = intent.Amount.Currency()
+	if intent.PromoCode == "" {
+		return nil, nil
+	}
+
+	promo, err := getPromoCode(ctx, intent.PromoCode)
+	if err != nil {
+		return nil, err
+	}
+	reason, err := checkPromoCustomer(ctx, promo, data.Email)
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		return []types.FieldError{{Field: "promoCode", Message: reason}}, nil
+	}
+	data.Promo = &AppliedPromo{Code: intent.PromoCode, Subtotal: intent.BasePrice, Discount: intent.Discount}
+	return nil, nil
+}
+
+type PromoCodeRequest struct {
+	Code         string `json:"code"`
+	Description  string `json:"description,omitempty"`
+	DiscountType string `json:"discountType"`
+	// Hundredths of a percent or minor units, as in PromoCode
+	DiscountValue     int64      `json:"discountValue"`
+	Plans             []string   `json:"plans,omitempty"`
+	ValidFrom         *time.Time `json:"validFrom,omitempty"`
+	ValidUntil        *time.Time `json:"validUntil,omitempty"`
+	MaxRedemptions    *int       `json:"maxRedemptions,omitempty"`
+	MaxPerCustomer    *int       `json:"maxPerCustomer,omitempty"`
+	FirstPurchaseOnly bool       `json:"firstPurchaseOnly"`
+	// Currency of a fixed discount, KZT when not sent
+	Currency types.Currency `json:"currency,omitempty"`
+}
+
+func handleCreatePromoCode(w http.ResponseWriter, r *http.Request) {
+	var req PromoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+	if fields := validatePromoCodeRequest(req); len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid promo code", fields...)
+		return
+	}
+
+	promo := PromoCode{
+		Code:              normalizePromoCode(req.Code),
+		Description:       req.Description,
+		DiscountType:      req.DiscountType,
+		DiscountValue:     req.DiscountValue,
+		Plans:             req.Plans,
+		ValidFrom:         time.Now(),
+		ValidUntil:        req.ValidUntil,
+		MaxRedemptions:    req.MaxRedemptions,
+		MaxPerCustomer:    req.MaxPerCustomer,
+		FirstPurchaseOnly: req.FirstPurchaseOnly,
+		Active:            true,
+		Currency:          req.Currency,
+	}
+	if promo.Currency == "" {
+		promo.Currency = baseCurrency
+	}
+	if promo.Plans == nil {
+		promo.Plans = []string{}
+	}
+	if req.ValidFrom != nil {
+		promo.ValidFrom = *req.ValidFrom
+	}
+
+	err := insertPromoCode(r.Context(), promo)
+	if isUniqueViolation(err) {
+		writeError(w, r, types.ErrCodeConflict, "Promo code already exists")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error inserting promo code", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error saving promo code")
+		return
+	}
+	writeJSON(w, http.StatusCreated, promo)
+}
+
+func validatePromoCodeRequest(req PromoCodeRequest) []types.FieldError {
+	var fields []types.FieldError
+	if code := normalizePromoCode(req.Code); code == "" || len(code) > 50 {
+		fields = append(fields, types.FieldError{Field: "code", Message: "must be 1 to 50 characters"})
+	}
+	switch req.DiscountType {
+	case discountTypePercent:
+		if req.DiscountValue <= 0 || req.DiscountValue >= 10000 {
+			fields = append(fields, types.FieldError{Field: "discountValue", Message: "must be between 1 and 9999 hundredths of a percent"})
+		}
+	case discountTypeFixed:
+		if req.DiscountValue <= 0 {
+			fields = append(fields, types.FieldError{Field: "discountValue", Message: "must be at least one minor unit"})
+		}
+	default:
+		fields = append(fields, types.FieldError{Field: "discountType", Message: fmt.Sprintf("must be %q or %q", discountTypePercent, discountTypeFixed)})
+	}
+	if req.Currency != "" && !isPaymentCurrency(req.Currency) {
+		fields = append(fields, types.FieldError{Field: "currency", Message: "must be one of " + paymentCurrencyList()})
+	}
+	if req.ValidFrom != nil && req.ValidUntil != nil && !req.ValidUntil.After(*req.ValidFrom) {
+		fields = append(fields, types.FieldError{Field: "validUntil", Message: "must be after validFrom"})
+	}
+	if req.MaxRedemptions != nil && *req.MaxRedemptions < 1 {
+		fields = append(fields, types.FieldError{Field: "maxRedemptions", Message: "must be at least 1"})
+	}
+	if req.MaxPerCustomer != nil && *req.MaxPerCustomer < 1 {
+		fields = append(fields, types.FieldError{Field: "maxPerCustomer", Message: "must be at least 1"})
+	}
+	return fields
+}
+
+func handleListPromoCodes(w http.ResponseWriter, r *http.Request) {
+	promos, err := listPromoCodes(r.Context())
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing promo codes", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading promo codes")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"promoCodes": promos})
+}
+
+// Order summary shown above the checkout form, with a discount line when a promo code applies
+func paymentSummaryHTML(intent *paymentIntent) string {
+	row := func(class, label, value string) string {
+		return `<div class="` + class + `"><span>` + html.EscapeString(label) + `</span><span>` + html.EscapeString(value) + `</span></div>`
+	}
+	summary := row("summary-row", intent.SubscriptionType, intent.BasePrice.Format("ru"))
+	if intent.PromoCode != "" {
+		summary += row("summary-row summary-discount", "Скидка (промокод "+intent.PromoCode+")", intent.Discount.Neg().Format("ru"))
+	}
+	summary += row("summary-row summary-total", "Итого", intent.Amount.Format("ru"))
+	return `<div class="summary">` + summary + `</div>`
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestPromoLimitsAllow(t *testing.T) {
+	two := 2
+	tests := []struct {
+		name   string
+		limits promoLimits
+		want   bool
+	}{
+		{"no caps", promoLimits{Redemptions: 100, CustomerRedemptions: 10}, true},
+		{"under the total cap", promoLimits{MaxRedemptions: &two, Redemptions: 1}, true},
+		{"at the total cap", promoLimits{MaxRedemptions: &two, Redemptions: 2}, false},
+		{"past the total cap", promoLimits{MaxRedemptions: &two, Redemptions: 3}, false},
+		{"under the customer cap", promoLimits{MaxPerCustomer: &two, CustomerRedemptions: 1}, true},
+		{"at the customer cap", promoLimits{MaxPerCustomer: &two, Redemptions: 1, CustomerRedemptions: 2}, false},
+		{"customer cap with room left in total", promoLimits{MaxRedemptions: &two, MaxPerCustomer: &two, Redemptions: 1, CustomerRedemptions: 1}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.limits.allow(); got != tt.want {
+			t.Errorf("%s: allow() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
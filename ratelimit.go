@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sportlife/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A token bucket: Burst tokens at most, refilled at Rate tokens per second
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Parse limits written as "<count>/<s|m|h>", e.g. "10/m" allows bursts of 10 refilled over a minute
+func parseRateLimit(s string) (rateLimit, error) {
+	count, period, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q", s)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[period]
+	if per == 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit period in %q", s)
+	}
+	return rateLimit{Rate: float64(n) / per.Seconds(), Burst: float64(n)}, nil
+}
+
+func envRateLimit(name, def string) rateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		value = def
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return limit
+}
+
+type tokenBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Refill the bucket up to now and try to take one token.
+// Returns whether the token was taken and, if not, how long until one is available.
+func (b *tokenBucket) take(limit rateLimit, now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(b.UpdatedAt).Seconds()
+	if elapsed > 0 {
+		b.Tokens = math.Min(limit.Burst, b.Tokens+elapsed*limit.Rate)
+	}
+	b.UpdatedAt = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	wait := (1 - b.Tokens) / limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// rateLimitStore keeps token buckets by key
+type rateLimitStore interface {
+	Take(ctx context.Context, key string, limit rateLimit) (allowed bool, retryAfter time.Duration, err error)
+	// Sweep drops buckets that have been idle for longer than maxIdle
+	Sweep(ctx context.Context, maxIdle time.Duration) error
+}
+
+// memoryRateLimitStore is enough for a single instance
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{Tokens: limit.Burst, UpdatedAt: now}
+		s.buckets[key] = b
+	}
+	allowed, retryAfter := b.take(limit, now)
+	return allowed, retryAfter, nil
+}
+
+func (s *memoryRateLimitStore) Sweep(ctx context.Context, maxIdle time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxIdle)
+	for key, b := range s.buckets {
+		if b.UpdatedAt.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// postgresRateLimitStore shares buckets between instances through the rate_limit_buckets table
+type postgresRateLimitStore struct {
+	db *sql.DB
+}
+
+func (s *postgresRateLimitStore) Take(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO rate_limit_buckets (key, tokens, updated_at) VALUES ($1, $2, $3)
+			  ON CONFLICT (key) DO NOTHING`, key, limit.Burst, now)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Lock the row so concurrent instances take tokens one at a time
+	var b tokenBucket
+	err = tx.QueryRowContext(ctx, `SELECT tokens, updated_at FROM rate_limit_buckets WHERE key = $1 FOR UPDATE`, key).
+		Scan(&b.Tokens, &b.UpdatedAt)
+	if err != nil {
+		return false, 0, err
+	}
+
+	allowed, retryAfter := b.take(limit, now)
+	_, err = tx.ExecContext(ctx, `UPDATE rate_limit_buckets SET tokens = $1, updated_at = $2 WHERE key = $3`, b.Tokens, b.UpdatedAt, key)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, tx.Commit()
+}
+
+func (s *postgresRateLimitStore) Sweep(ctx context.Context, maxIdle time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM rate_limit_buckets WHERE updated_at < $1`, time.Now().Add(-maxIdle))
+	return err
+}
+
+// One limit applied to requests sharing the same key. An empty key means the rule does not apply.
+type rateLimitRule struct {
+	name  string
+	limit rateLimit
+	key   func(c *gin.Context) string
+}
+
+type rateLimiter struct {
+	store rateLimitStore
+	ip    rateLimitRule
+	email rateLimitRule
+	card  rateLimitRule
+}
+
+const (
+	rateLimitSweepInterval = time.Minute
+	rateLimitMaxIdle       = time.Hour
+)
+
+// Build the limiter from the environment:
+// RATE_LIMIT_STORE (memory or postgres), RATE_LIMIT_PER_IP, RATE_LIMIT_PER_EMAIL, RATE_LIMIT_PER_CARD.
+func newRateLimiterFromEnv(db *sql.DB) *rateLimiter {
+	var store rateLimitStore
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "memory":
+		store = newMemoryRateLimitStore()
+	case "postgres":
+		store = &postgresRateLimitStore{db: db}
+	default:
+		log.Fatalf("RATE_LIMIT_STORE: unknown store %q", os.Getenv("RATE_LIMIT_STORE"))
+	}
+
+	return &rateLimiter{
+		store: store,
+		ip:    rateLimitRule{"ip", envRateLimit("RATE_LIMIT_PER_IP", "30/m"), func(c *gin.Context) string { return c.ClientIP() }},
+		email: rateLimitRule{"email", envRateLimit("RATE_LIMIT_PER_EMAIL", "5/h"), paymentEmailKey},
+		card:  rateLimitRule{"card", envRateLimit("RATE_LIMIT_PER_CARD", "5/h"), paymentCardKey},
+	}
+}
+
+// Periodically drop idle buckets so the store does not grow without bound
+func (l *rateLimiter) startSweeper() {
+	goBackground(func(stop context.Context) {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-ticker.C:
+				if err := l.store.Sweep(stop, rateLimitMaxIdle); err != nil {
+					log.Printf("Error sweeping rate limit buckets: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// Middleware enforcing the given rules in order; the first exhausted bucket answers 429
+func (l *rateLimiter) middleware(rules ...rateLimitRule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, rule := range rules {
+			key := rule.key(c)
+			if key == "" {
+				continue
+			}
+
+			allowed, retryAfter, err := l.store.Take(c.Request.Context(), rule.name+":"+key, rule.limit)
+			if err != nil {
+				// Fail open: an unavailable store must not take payments down with it
+				logFrom(c.Request.Context()).Error("Error checking rate limit", "rule", rule.name, "error", err)
+				continue
+			}
+			if !allowed {
+				rateLimitedTotal.WithLabelValues(rule.name).Inc()
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				abortWithError(c, types.ErrCodeRateLimited, "Too many requests, please retry later")
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Decode the payment body once per request without consuming it for the handler
+func peekPaymentData(c *gin.Context) (PaymentData, bool) {
+	if v, ok := c.Get("paymentData"); ok {
+		data, ok := v.(PaymentData)
+		return data, ok
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return PaymentData{}, false
+	}
+	var data PaymentData
+	if err := json.Unmarshal(body, &data); err != nil {
+		return PaymentData{}, false
+	}
+	c.Set("paymentData", data)
+	return data, true
+}
+
+func paymentEmailKey(c *gin.Context) string {
+	data, ok := peekPaymentData(c)
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(data.Email))
+}
+
+// Payments with a saved card count against the same bucket as ones typing its number in
+func paymentCardKey(c *gin.Context) string {
+	data, ok := peekPaymentData(c)
+	if !ok {
+		return ""
+	}
+	if data.PaymentMethodID != 0 {
+		fingerprint, err := getPaymentMethodFingerprint(c.Request.Context(), data.PaymentMethodID)
+		if err != nil && err != sql.ErrNoRows {
+			logFrom(c.Request.Context()).Error("Error loading payment method for rate limiting", "payment_method_id", data.PaymentMethodID, "error", err)
+		}
+		return fingerprint
+	}
+	if data.CardNumber == "" {
+		return ""
+	}
+	return cardFingerprint(data.CardNumber)
+}
+
+// Keyed hash identifying a card without storing or logging its number
+func cardFingerprint(cardNumber string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("CARD_FINGERPRINT_KEY")))
+	mac.Write([]byte(cardNumber))
+	return hex.EncodeToString(mac.Sum(nil))
+}
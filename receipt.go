@@ -1,47 +1,169 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"net/url"
+	"os"
+	"time"
 
 	"github.com/jung-kurt/gofpdf"
 )
 
-func generateReceipt(payment SubscriptionPayment) error {
-	// Create PDF
+const (
+	receiptsDir     = "receipts"
+	fontRegularPath = "font/DejaVuSans.ttf"
+	fontBoldPath    = "font/DejaVuSans-Bold.ttf"
+)
+
+// Font files are read once at startup and shared by every receipt
+var fontRegular, fontBold []byte
+
+// Read the receipt fonts and make sure gofpdf can parse them
+func loadReceiptFonts() error {
+	var err error
+	if fontRegular, err = os.ReadFile(fontRegularPath); err != nil {
+		return err
+	}
+	if fontBold, err = os.ReadFile(fontBoldPath); err != nil {
+		return err
+	}
+	pdf := newReceiptPDF()
+	return pdf.Error()
+}
+
+// Create an empty receipt document with the DejaVu fonts registered
+func newReceiptPDF() *gofpdf.Fpdf {
 	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes("DejaVu", "", fontRegular)
+	pdf.AddUTF8FontFromBytes("DejaVu", "B", fontBold)
+	return pdf
+}
+
+func generateReceipt(ctx context.Context, data PaymentData) (string, error) {
+	defer func(start time.Time) {
+		receiptGenerationDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	if err := os.MkdirAll(receiptsDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Amounts are formatted for the customer's locale
+	locale := data.Locale
+	if locale == "" {
+		locale = defaultCustomerLocale
+	}
+
+	// Create new PDF with Unicode support
+	pdf := newReceiptPDF()
 	pdf.AddPage()
 	
-	// Add company logo and header
-	pdf.SetFont("Arial", "B", 16)
-	pdf.Cell(190, 10, "SportLife Gym")
+	// Title
+	pdf.SetFont("DejaVu", "B", 16)
+	pdf.Cell(190, 10, "Квитанция об оплате")
+	pdf.Ln(15)
 	
-	// Add receipt details
-	pdf.SetFont("Arial", "", 12)
-	pdf.Ln(10)
-	pdf.Cell(190, 10, fmt.Sprintf("Transaction ID: %s", payment.TransactionID))
-	pdf.Ln(10)
-	pdf.Cell(190, 10, fmt.Sprintf("Date: %s", payment.PaymentTime.Format("2006-01-02 15:04:05")))
-	pdf.Ln(10)
-	pdf.Cell(190, 10, fmt.Sprintf("Customer: %s", payment.Customer.Name))
-	pdf.Ln(10)
-	pdf.Cell(190, 10, fmt.Sprintf("Subscription: %s", payment.SubscriptionType))
-	pdf.Ln(10)
-	pdf.Cell(190, 10, fmt.Sprintf("Amount: %.2f KZT", payment.Amount))
+	// Content
+	pdf.SetFont("DejaVu", "", 12)
 	
-	// Save PDF
-	filename := fmt.Sprintf("receipts/receipt_%s.pdf", payment.TransactionID)
-	if err := pdf.OutputFileAndClose(filename); err != nil {
-		return err
+	// Function to add a row with label and value
+	addRow := func(label, value string) {
+		pdf.CellFormat(50, 8, label, "", 0, "L", false, 0, "")
+		pdf.CellFormat(140, 8, value, "", 0, "L", false, 0, "")
+		pdf.Ln(10)
+	}
+	
+	// Fiscal details of the seller
+	if taxConfig.Seller.Name != "" {
+		addRow("Продавец:", taxConfig.Seller.Name)
+	}
+	if taxConfig.Seller.BIN != "" {
+		addRow("БИН:", taxConfig.Seller.BIN)
 	}
+	addRow("Номер чека:", data.TransactionID)
+
+	// Add content rows
+	currentTime := time.Now().Format("02.01.2006 15:04:05")
+	addRow("Дата:", currentTime)
+	addRow("ФИО:", data.Name)
+	addRow("Email:", data.Email)
+	addRow("Телефон:", data.Phone)
+	if len(data.Items) > 0 {
+		addLineItems(pdf, data.Items, data.Tax.Lines, locale)
+	}
+	if data.Promo != nil {
+		addRow("Стоимость:", data.Promo.Subtotal.Format(locale))
+		addRow("Скидка:", fmt.Sprintf("%s (промокод %s)", data.Promo.Discount.Neg().Format(locale), data.Promo.Code))
+	}
+	addRow("Сумма:", data.Amount.Format(locale))
+	addTaxRows(pdf, data.Tax, locale)
+	
+	// Add some space before footer
+	pdf.Ln(10)
 	
-	// Send email with receipt
-	return sendEmail(payment.Customer.Email, filename, payment)
+	// Footer
+	pdf.SetFont("DejaVu", "", 10)
+	pdf.Cell(190, 8, "Спасибо за оплату!")
+	pdf.Ln(8)
+	pdf.Cell(190, 8, "С уважением, SportLife")
+	
+	// One receipt per payment; the ID is escaped as it may come from the client
+	filename := fmt.Sprintf("%s/receipt_%s.pdf", receiptsDir, url.PathEscape(data.TransactionID))
+	
+	// Rendering is not interruptible, but a job that ran out of time should not leave a file behind
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	err := pdf.OutputFileAndClose(filename)
+	return filename, err
 }
 
-func sendReceiptEmail(email, receiptPath string) error {
-	// Implement email sending logic here
-	// For now, just log it
-	log.Printf("Would send receipt to %s: %s", email, receiptPath)
-	return nil
-} 
\ No newline at end of file
+// Print one row per purchased item with the VAT it includes. taxLines are in the same order as items.
+func addLineItems(pdf *gofpdf.Fpdf, items []LineItem, taxLines []TaxLine, locale string) {
+	pdf.Ln(2)
+	pdf.SetFont("DejaVu", "B", 10)
+	pdf.CellFormat(70, 8, "Наименование", "B", 0, "L", false, 0, "")
+	pdf.CellFormat(15, 8, "Кол-во", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 8, "Цена", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(45, 8, "НДС", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 8, "Сумма", "B", 1, "R", false, 0, "")
+
+	pdf.SetFont("DejaVu", "", 10)
+	for i, item := range items {
+		tax := ""
+		if i < len(taxLines) {
+			line := taxLines[i]
+			tax = taxRateLabel(line.Rate, line.Exempt)
+			if !line.Exempt {
+				tax += ": " + line.Tax.FormatNumber(locale)
+			}
+		}
+		pdf.CellFormat(70, 7, item.Name, "", 0, "L", false, 0, "")
+		pdf.CellFormat(15, 7, fmt.Sprintf("%d", item.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, item.UnitPrice.FormatNumber(locale), "", 0, "R", false, 0, "")
+		pdf.CellFormat(45, 7, tax, "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, item.Total.FormatNumber(locale), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+	pdf.SetFont("DejaVu", "", 12)
+}
+
+// Print the VAT included in the total, one row per rate
+func addTaxRows(pdf *gofpdf.Fpdf, tax TaxBreakdown, locale string) {
+	pdf.SetFont("DejaVu", "", 10)
+	for _, rate := range tax.Rates {
+		label := "в т.ч. " + taxRateLabel(rate.Rate, rate.Exempt) + ":"
+		value := rate.Tax.Format(locale)
+		if rate.Exempt {
+			label = taxRateLabel(rate.Rate, rate.Exempt) + ":"
+			value = rate.Gross.Format(locale)
+		}
+		pdf.CellFormat(50, 7, label, "", 0, "L", false, 0, "")
+		pdf.CellFormat(140, 7, value, "", 1, "L", false, 0, "")
+	}
+	pdf.CellFormat(50, 7, "Сумма без НДС:", "", 0, "L", false, 0, "")
+	pdf.CellFormat(140, 7, tax.Net.Format(locale), "", 1, "L", false, 0, "")
+	pdf.Ln(3)
+	pdf.SetFont("DejaVu", "", 12)
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+// Outcome of reconciling one transaction against the acquirer's settlement file
+const (
+	reconciliationMatched             = "matched"
+	reconciliationMissingInDB         = "missing_in_db"
+	reconciliationMissingInSettlement = "missing_in_settlement"
+	reconciliationAmountMismatch      = "amount_mismatch"
+	reconciliationDateMismatch        = "date_mismatch"
+	// The acquirer settled a charge recorded as failed or declined, so the customer paid without
+	// getting what they paid for
+	reconciliationSettledButFailed = "settled_but_failed"
+)
+
+// Kinds of settlement lines. Refunds and reversals are separate lines from the charge they give
+// money back on, so a transaction may appear once as each.
+const (
+	settlementPayment  = "payment"
+	settlementRefund   = "refund"
+	settlementReversal = "reversal"
+)
+
+// Days after its capture the acquirer may take to settle a payment
+const settlementWindowDays = 3
+
+const maxSettlementFile = 20 << 20
+
+// Longest transaction ID payment_transactions can hold
+const maxTransactionIDLength = 50
+
+const (
+	defaultReconciliationLimit = 20
+	maxReconciliationLimit     = 100
+)
+
+// Payments the acquirer captured and so has to settle. Refunds and reversals are settled as
+// separate entries, so the original charge still appears in the file.
+var capturedPaymentStatuses = []string{paymentStatusSuccess, paymentStatusRefunded, paymentStatusReversed}
+
+// One line of a settlement file
+type SettlementItem struct {
+	TransactionID string
+	Type          string
+	// Money moved, positive whichever way it went
+	Amount    types.Money
+	SettledOn time.Time
+}
+
+// A settlement file checked against payment_transactions, kept for finance to review
+type Reconciliation struct {
+	ID     int64  `json:"id"`
+	Source string `json:"source"`
+	Format string `json:"format"`
+	// Capture dates of the payments expected in the file, inclusive
+	PeriodFrom string                `json:"periodFrom"`
+	PeriodTo   string                `json:"periodTo"`
+	Summary    ReconciliationSummary `json:"summary"`
+	CreatedBy  string                `json:"createdBy"`
+	CreatedAt  time.Time             `json:"createdAt"`
+	Items      []ReconciliationItem  `json:"items,omitempty"`
+}
+
+// Number of items with each outcome
+type ReconciliationSummary struct {
+	Matched             int `json:"matched"`
+	MissingInDB         int `json:"missingInDb"`
+	MissingInSettlement int `json:"missingInSettlement"`
+	AmountMismatch      int `json:"amountMismatch"`
+	DateMismatch        int `json:"dateMismatch"`
+	SettledButFailed    int `json:"settledButFailed"`
+}
+
+type ReconciliationItem struct {
+	Status        string `json:"status"`
+	TransactionID string `json:"transactionId"`
+	// Kind of settlement line; payment for payments missing from the settlement
+	Type string `json:"type"`
+	// As the acquirer settled it; absent for missing_in_settlement
+	SettledAmount   *types.Money   `json:"settledAmount,omitempty"`
+	SettledCurrency types.Currency `json:"settledCurrency,omitempty"`
+	SettledOn       string         `json:"settledOn,omitempty"`
+	// As payment_transactions records it, or payment_refunds for a refund; absent when the
+	// transaction is unknown
+	RecordedAmount   *types.Money   `json:"recordedAmount,omitempty"`
+	RecordedCurrency types.Currency `json:"recordedCurrency,omitempty"`
+	PaymentStatus    string         `json:"paymentStatus,omitempty"`
+	PaymentTime      *time.Time     `json:"paymentTime,omitempty"`
+	Note             string         `json:"note,omitempty"`
+}
+
+func (s *ReconciliationSummary) count(status string) {
+	switch status {
+	case reconciliationMatched:
+		s.Matched++
+	case reconciliationMissingInDB:
+		s.MissingInDB++
+	case reconciliationMissingInSettlement:
+		s.MissingInSettlement++
+	case reconciliationAmountMismatch:
+		s.AmountMismatch++
+	case reconciliationDateMismatch:
+		s.DateMismatch++
+	case reconciliationSettledButFailed:
+		s.SettledButFailed++
+	}
+}
+
+var reconciliationStatuses = []string{reconciliationMatched, reconciliationMissingInDB, reconciliationMissingInSettlement,
+	reconciliationAmountMismatch, reconciliationDateMismatch, reconciliationSettledButFailed}
+
+func isReconciliationStatus(status string) bool {
+	return contains(reconciliationStatuses, status)
+}
+
+func isCapturedPayment(status string) bool {
+	for _, s := range capturedPaymentStatuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A settlement line before parsing, with the names its columns have in the file
+type settlementRecord struct {
+	// Where the line is in the file, e.g. "line 3" or "items[2]"
+	position string
+	values   map[string]string
+	columns  map[string]string
+}
+
+var (
+	settlementCSVColumns  = map[string]string{"transactionId": "transaction_id", "type": "type", "amount": "amount", "currency": "currency", "settledAt": "settled_at"}
+	settlementJSONColumns = map[string]string{"transactionId": "transactionId", "type": "type", "amount": "amount", "currency": "currency", "settledAt": "settledAt"}
+)
+
+func (rec settlementRecord) fieldError(column, message string) types.FieldError {
+	return types.FieldError{Field: rec.position + "." + rec.columns[column], Message: message}
+}
+
+// Parse a settlement line. Amounts without a currency are in the base currency; settledAt is a
+// date, or a timestamp whose local date is taken. A line without a type is a payment, or a refund
+// when its amount is negative; refunds and reversals may be written either positive or negative.
+func (rec settlementRecord) parse() (SettlementItem, []types.FieldError) {
+	var item SettlementItem
+	var fields []types.FieldError
+	item.TransactionID = strings.TrimSpace(rec.values["transactionId"])
+	if item.TransactionID == "" {
+		fields = append(fields, rec.fieldError("transactionId", "is required"))
+	} else if len(item.TransactionID) > maxTransactionIDLength {
+		fields = append(fields, rec.fieldError("transactionId", "must be at most "+strconv.Itoa(maxTransactionIDLength)+" characters"))
+	}
+
+	item.Type = strings.ToLower(strings.TrimSpace(rec.values["type"]))
+	if item.Type != "" && item.Type != settlementPayment && item.Type != settlementRefund && item.Type != settlementReversal {
+		fields = append(fields, rec.fieldError("type", "must be one of payment, refund, reversal"))
+	}
+	currency := types.Currency(strings.ToUpper(strings.TrimSpace(rec.values["currency"])))
+	if currency == "" {
+		currency = baseCurrency
+	}
+	if !currency.Valid() {
+		fields = append(fields, rec.fieldError("currency", "must be one of "+paymentCurrencyList()))
+	} else if amount, err := types.ParseMoney(strings.TrimSpace(rec.values["amount"]), currency); err != nil || amount.IsZero() {
+		fields = append(fields, rec.fieldError("amount", "must be a non-zero amount in "+string(currency)))
+	} else {
+		if item.Type == "" {
+			item.Type = settlementPayment
+			if amount.IsNegative() {
+				item.Type = settlementRefund
+			}
+		}
+		switch {
+		case item.Type == settlementPayment && amount.IsNegative():
+			fields = append(fields, rec.fieldError("amount", "must be positive for a payment"))
+		case amount.IsNegative():
+			amount = amount.Neg()
+		}
+		item.Amount = amount
+	}
+
+	settledAt := strings.TrimSpace(rec.values["settledAt"])
+	if day, err := time.Parse(rateDateLayout, settledAt); err == nil {
+		item.SettledOn = day
+	} else if t, err := time.Parse(time.RFC3339, settledAt); err == nil {
+		item.SettledOn = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	} else {
+		fields = append(fields, rec.fieldError("settledAt", "must be a date like 2026-01-31 or an RFC 3339 timestamp"))
+	}
+	return item, fields
+}
+
+// Read a settlement file: CSV with a header row naming transaction_id, amount, settled_at and
+// optional type and currency columns, or JSON like
+// {"items": [{"transactionId", "type", "amount", "currency", "settledAt"}]}
+func parseSettlementFile(format string, body io.Reader) ([]SettlementItem, []types.FieldError) {
+	var records []settlementRecord
+	var fields []types.FieldError
+	switch format {
+	case "csv":
+		records, fields = readSettlementCSV(body)
+	case "json":
+		records, fields = readSettlementJSON(body)
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+	if len(records) == 0 {
+		return nil, []types.FieldError{{Field: "file", Message: "has no settlement lines"}}
+	}
+
+	items := make([]SettlementItem, 0, len(records))
+	seen := make(map[string]string)
+	for _, rec := range records {
+		item, errs := rec.parse()
+		fields = append(fields, errs...)
+		key := item.Type + " " + item.TransactionID
+		if first, ok := seen[key]; ok && item.TransactionID != "" && item.Type != "" {
+			fields = append(fields, rec.fieldError("transactionId", "has a second "+item.Type+" line, first at "+first))
+		} else {
+			seen[key] = rec.position
+		}
+		items = append(items, item)
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+	return items, nil
+}
+
+func readSettlementCSV(body io.Reader) ([]settlementRecord, []types.FieldError) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, []types.FieldError{{Field: "file", Message: "is not valid CSV: " + err.Error()}}
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	index := make(map[string]int)
+	for i, name := range rows[0] {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	var fields []types.FieldError
+	for _, name := range []string{"transaction_id", "amount", "settled_at"} {
+		if _, ok := index[name]; !ok {
+			fields = append(fields, types.FieldError{Field: "file", Message: "has no " + name + " column"})
+		}
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+
+	records := make([]settlementRecord, 0, len(rows)-1)
+	for n, row := range rows[1:] {
+		values := make(map[string]string)
+		for field, column := range settlementCSVColumns {
+			if i, ok := index[column]; ok {
+				values[field] = row[i]
+			}
+		}
+		records = append(records, settlementRecord{position: "line " + strconv.Itoa(n+2), values: values, columns: settlementCSVColumns})
+	}
+	return records, nil
+}
+
+func readSettlementJSON(body io.Reader) ([]settlementRecord, []types.FieldError) {
+	var file struct {
+		Items []struct {
+			TransactionID string      `json:"transactionId"`
+			Type          string      `json:"type"`
+			Amount        json.Number `json:"amount"`
+			Currency      string      `json:"currency"`
+			SettledAt     string      `json:"settledAt"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&file); err != nil {
+		return nil, []types.FieldError{{Field: "file", Message: "is not a valid settlement document: " + err.Error()}}
+	}
+
+	records := make([]settlementRecord, len(file.Items))
+	for i, item := range file.Items {
+		records[i] = settlementRecord{
+			position: fmt.Sprintf("items[%d]", i),
+			values: map[string]string{
+				"transactionId": item.TransactionID,
+				"type":          item.Type,
+				"amount":        item.Amount.String(),
+				"currency":      item.Currency,
+				"settledAt":     item.SettledAt,
+			},
+			columns: settlementJSONColumns,
+		}
+	}
+	return records, nil
+}
+
+// Day a time falls on, as a midnight UTC date comparable with settlement dates
+func dateOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// What the service recorded about the transactions a settlement file mentions
+type settlementLedger struct {
+	Payments map[string]*Payment
+	Refunds  map[string]recordedRefunds
+	// The acquirer's reversal callbacks that were applied, by transaction ID
+	Reversals map[string]recordedReversal
+}
+
+// A reversal the acquirer's callback reported
+type recordedReversal struct {
+	At time.Time
+	// What the callback said was taken back; nil when it did not say
+	Amount *types.Money
+}
+
+// The refunds of a payment added up
+type recordedRefunds struct {
+	Total  types.Money
+	LastAt time.Time
+}
+
+// Match settlement lines to payments by transaction ID, then check the amount and that the
+// settlement came within settlementWindowDays of the capture. Captured payments from the period
+// that the file does not mention are reported as missing from the settlement. A zero period
+// covers the capture dates of the payments the file matched, short of the last
+// settlementWindowDays, whose captures may well be settled in the next file.
+func reconcileSettlement(ctx context.Context, items []SettlementItem, from, to time.Time, now time.Time) (*Reconciliation, error) {
+	ids := make([]string, len(items))
+	var settled []string
+	for i, item := range items {
+		ids[i] = item.TransactionID
+		if item.Type == settlementPayment {
+			settled = append(settled, item.TransactionID)
+		}
+	}
+	var ledger settlementLedger
+	var err error
+	if ledger.Payments, err = getPaymentsByTransactionID(ctx, ids); err != nil {
+		return nil, err
+	}
+	if ledger.Refunds, err = getRefundTotals(ctx, ids); err != nil {
+		return nil, err
+	}
+	if ledger.Reversals, err = getReversals(ctx, ids); err != nil {
+		return nil, err
+	}
+
+	rec := &Reconciliation{Items: matchSettlement(items, ledger)}
+	unsettledTo := to.AddDate(0, 0, 1)
+	if from.IsZero() || to.IsZero() {
+		from, to = settlementPeriod(items, ledger.Payments)
+		unsettledTo = to.AddDate(0, 0, 1)
+		if cutoff := now.AddDate(0, 0, -settlementWindowDays); cutoff.Before(unsettledTo) {
+			unsettledTo = cutoff
+		}
+	}
+
+	if !from.IsZero() {
+		rec.PeriodFrom = from.Format(rateDateLayout)
+		rec.PeriodTo = to.Format(rateDateLayout)
+		missing, err := listUnsettledPayments(ctx, from, unsettledTo, settled)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range missing {
+			recorded := p.Amount
+			paymentTime := p.PaymentTime
+			rec.Items = append(rec.Items, ReconciliationItem{
+				Status:           reconciliationMissingInSettlement,
+				TransactionID:    p.TransactionID,
+				Type:             settlementPayment,
+				RecordedAmount:   &recorded,
+				RecordedCurrency: p.Currency,
+				PaymentStatus:    p.Status,
+				PaymentTime:      &paymentTime,
+				Note:             "Captured in the period but not in the settlement file",
+			})
+		}
+	}
+	for _, item := range rec.Items {
+		rec.Summary.count(item.Status)
+	}
+	return rec, nil
+}
+
+// Capture dates of the captured payments the file settles, zero when it settles none
+func settlementPeriod(items []SettlementItem, payments map[string]*Payment) (from, to time.Time) {
+	for _, item := range items {
+		p, ok := payments[item.TransactionID]
+		if item.Type != settlementPayment || !ok || !isCapturedPayment(p.Status) {
+			continue
+		}
+		day := dateOf(p.PaymentTime)
+		if from.IsZero() || day.Before(from) {
+			from = day
+		}
+		if to.IsZero() || day.After(to) {
+			to = day
+		}
+	}
+	return from, to
+}
+
+// Check each settlement line against what the ledger recorded for its transaction
+func matchSettlement(items []SettlementItem, ledger settlementLedger) []ReconciliationItem {
+	results := make([]ReconciliationItem, 0, len(items))
+	for _, item := range items {
+		amount := item.Amount
+		result := ReconciliationItem{
+			TransactionID:   item.TransactionID,
+			Type:            item.Type,
+			SettledAmount:   &amount,
+			SettledCurrency: amount.Currency(),
+			SettledOn:       item.SettledOn.Format(rateDateLayout),
+		}
+		p, ok := ledger.Payments[item.TransactionID]
+		if !ok {
+			result.Status = reconciliationMissingInDB
+			result.Note = "No such transaction"
+			results = append(results, result)
+			continue
+		}
+		paymentTime := p.PaymentTime
+		result.PaymentStatus = p.Status
+		result.PaymentTime = &paymentTime
+
+		switch item.Type {
+		case settlementRefund:
+			matchRefund(&result, item, ledger.Refunds[item.TransactionID])
+		case settlementReversal:
+			reversal, known := ledger.Reversals[item.TransactionID]
+			matchReversal(&result, item, p, ledger.Refunds[item.TransactionID], reversal, known)
+		default:
+			matchPayment(&result, item, p)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func matchPayment(result *ReconciliationItem, item SettlementItem, p *Payment) {
+	recorded := p.Amount
+	result.RecordedAmount = &recorded
+	result.RecordedCurrency = p.Currency
+	switch {
+	case p.Status == paymentStatusFailed || p.Status == paymentStatusDeclined:
+		result.Status = reconciliationSettledButFailed
+		result.Note = "Recorded as " + p.Status + ", so the customer was charged for nothing"
+	case !isCapturedPayment(p.Status):
+		result.Status = reconciliationMissingInDB
+		result.Note = "Recorded as " + p.Status + ", not as a captured payment"
+	default:
+		checkSettledAmount(result, item, p.Amount, p.PaymentTime)
+	}
+}
+
+// A refund line settles everything refunded on the payment
+func matchRefund(result *ReconciliationItem, item SettlementItem, refunds recordedRefunds) {
+	if refunds.LastAt.IsZero() {
+		result.Status = reconciliationMissingInDB
+		result.Note = "No refund recorded"
+		return
+	}
+	recorded := refunds.Total
+	result.RecordedAmount = &recorded
+	result.RecordedCurrency = recorded.Currency()
+	checkSettledAmount(result, item, refunds.Total, refunds.LastAt)
+}
+
+// A reversal takes back what the acquirer's callback said it did, or else what had not been
+// refunded yet. Its date is only checked when the acquirer's reversal callback was received.
+func matchReversal(result *ReconciliationItem, item SettlementItem, p *Payment, refunds recordedRefunds, reversal recordedReversal, known bool) {
+	if p.Status != paymentStatusReversed {
+		result.Status = reconciliationMissingInDB
+		result.Note = "Recorded as " + p.Status + ", not as reversed"
+		return
+	}
+	expected := p.Amount
+	if reversal.Amount != nil {
+		expected = *reversal.Amount
+	} else if !refunds.LastAt.IsZero() {
+		var err error
+		if expected, err = p.Amount.Sub(refunds.Total); err != nil {
+			result.Status = reconciliationAmountMismatch
+			result.Note = "Refunded in " + string(refunds.Total.Currency()) + ", paid in " + string(p.Currency)
+			return
+		}
+	}
+	result.RecordedAmount = &expected
+	result.RecordedCurrency = expected.Currency()
+	reversedAt := reversal.At
+	if !known {
+		reversedAt = item.SettledOn
+	}
+	checkSettledAmount(result, item, expected, reversedAt)
+}
+
+// Compare a line with the amount recorded for it and the time the money moved
+func checkSettledAmount(result *ReconciliationItem, item SettlementItem, recorded types.Money, at time.Time) {
+	if !recorded.Equal(item.Amount) {
+		result.Status = reconciliationAmountMismatch
+		result.Note = fmt.Sprintf("Settled %s %s, recorded %s %s", item.Amount.Decimal(), item.Amount.Currency(), recorded.Decimal(), recorded.Currency())
+		return
+	}
+	days := int(item.SettledOn.Sub(dateOf(at)).Hours() / 24)
+	if days < 0 || days > settlementWindowDays {
+		event := item.Type
+		if event == settlementPayment {
+			event = "capture"
+		}
+		result.Status = reconciliationDateMismatch
+		result.Note = fmt.Sprintf("Settled %d days after the %s, expected 0 to %d", days, event, settlementWindowDays)
+		return
+	}
+	result.Status = reconciliationMatched
+}
+
+// Format of a settlement upload, from its Content-Type
+func settlementFormat(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return "csv"
+	case "application/json":
+		return "json"
+	}
+	return ""
+}
+
+// Parse an optional from/to query date
+func queryDate(r *http.Request, name string, fields *[]types.FieldError) time.Time {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}
+	}
+	day, err := time.Parse(rateDateLayout, v)
+	if err != nil {
+		*fields = append(*fields, types.FieldError{Field: name, Message: "must be a date like 2026-01-31"})
+	}
+	return day
+}
+
+// Reconcile an uploaded settlement file and store the report. The file is the request body, sent
+// as text/csv or application/json; source names it in the report.
+func handleCreateReconciliation(w http.ResponseWriter, r *http.Request) {
+	format := settlementFormat(r)
+	if format == "" {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Send the settlement file as text/csv or application/json")
+		return
+	}
+	var fields []types.FieldError
+	from := queryDate(r, "from", &fields)
+	to := queryDate(r, "to", &fields)
+	if from.IsZero() != to.IsZero() {
+		fields = append(fields, types.FieldError{Field: "to", Message: "must be given together with from"})
+	} else if to.Before(from) {
+		fields = append(fields, types.FieldError{Field: "to", Message: "must not be before from"})
+	}
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "upload"
+	}
+	if len(source) > 255 {
+		fields = append(fields, types.FieldError{Field: "source", Message: "must be at most 255 characters"})
+	}
+	if len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid reconciliation", fields...)
+		return
+	}
+
+	items, fields := parseSettlementFile(format, http.MaxBytesReader(w, r.Body, maxSettlementFile))
+	if len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid settlement file", fields...)
+		return
+	}
+	rec, err := reconcileSettlement(r.Context(), items, from, to, time.Now())
+	if err != nil {
+		logFrom(r.Context()).Error("Error reconciling settlement file", "source", source, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error reconciling settlement file")
+		return
+	}
+	rec.Source = source
+	rec.Format = format
+	rec.CreatedBy = userID(r.Context())
+	if err := insertReconciliation(r.Context(), rec); err != nil {
+		logFrom(r.Context()).Error("Error storing reconciliation", "source", source, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error saving reconciliation")
+		return
+	}
+	logFrom(r.Context()).Info("Settlement file reconciled", "reconciliation_id", rec.ID, "source", source, "lines", len(items),
+		"matched", rec.Summary.Matched, "missing_in_db", rec.Summary.MissingInDB, "missing_in_settlement", rec.Summary.MissingInSettlement,
+		"amount_mismatch", rec.Summary.AmountMismatch, "date_mismatch", rec.Summary.DateMismatch, "settled_but_failed", rec.Summary.SettledButFailed)
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+// List stored reconciliations, newest first, without their items
+func handleListReconciliations(w http.ResponseWriter, r *http.Request) {
+	limit := defaultReconciliationLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReconciliationLimit {
+			writeError(w, r, types.ErrCodeValidationFailed, "Invalid limit",
+				types.FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxReconciliationLimit)})
+			return
+		}
+		limit = n
+	}
+	recs, err := listReconciliations(r.Context(), limit)
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing reconciliations", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading reconciliations")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reconciliations": recs})
+}
+
+// Get a reconciliation report, optionally only the items with one status
+func handleGetReconciliation(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && !isReconciliationStatus(status) {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid status",
+			types.FieldError{Field: "status", Message: "must be one of " + strings.Join(reconciliationStatuses, ", ")})
+		return
+	}
+	rec, err := getReconciliation(r.Context(), id, status)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Reconciliation not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading reconciliation", "reconciliation_id", id, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading reconciliation")
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"sportlife/types"
+)
+
+func TestParseSettlementFile(t *testing.T) {
+	csv := "transaction_id,type,amount,currency,settled_at\n" +
+		"TRX-1,,100.00,,2026-10-02\n" +
+		"TRX-1,,-40.00,,2026-10-03\n" +
+		"TRX-1,reversal,60.00,,2026-10-04T10:00:00+05:00\n" +
+		"TRX-2,refund,15.50,USD,2026-10-02\n"
+	items, fields := parseSettlementFile("csv", strings.NewReader(csv))
+	if len(fields) > 0 {
+		t.Fatalf("unexpected errors: %+v", fields)
+	}
+	want := []struct {
+		id, kind string
+		minor    int64
+		currency types.Currency
+		on       string
+	}{
+		{"TRX-1", settlementPayment, 10000, types.KZT, "2026-10-02"},
+		{"TRX-1", settlementRefund, 4000, types.KZT, "2026-10-03"},
+		{"TRX-1", settlementReversal, 6000, types.KZT, "2026-10-04"},
+		{"TRX-2", settlementRefund, 1550, types.USD, "2026-10-02"},
+	}
+	for i, w := range want {
+		item := items[i]
+		if item.TransactionID != w.id || item.Type != w.kind || item.Amount.Minor() != w.minor ||
+			item.Amount.Currency() != w.currency || item.SettledOn.Format(rateDateLayout) != w.on {
+			t.Errorf("item %d = %+v, want %+v", i, item, w)
+		}
+	}
+
+	json := `{"items": [{"transactionId": "TRX-3", "type": "refund", "amount": "-5", "settledAt": "2026-10-02"}]}`
+	items, fields = parseSettlementFile("json", strings.NewReader(json))
+	if len(fields) > 0 || len(items) != 1 || items[0].Type != settlementRefund || items[0].Amount.Minor() != 500 {
+		t.Errorf("JSON refund = %+v, %+v", items, fields)
+	}
+}
+
+func TestParseSettlementFileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		csv   string
+		field string
+	}{
+		{"second payment line", "transaction_id,amount,settled_at\nTRX-1,10,2026-10-02\nTRX-1,10,2026-10-03\n", "line 3.transaction_id"},
+		{"second refund line", "transaction_id,amount,settled_at\nTRX-1,-1,2026-10-02\nTRX-1,-2,2026-10-03\n", "line 3.transaction_id"},
+		{"negative payment", "transaction_id,type,amount,settled_at\nTRX-1,payment,-10,2026-10-02\n", "line 2.amount"},
+		{"zero amount", "transaction_id,amount,settled_at\nTRX-1,0,2026-10-02\n", "line 2.amount"},
+		{"unknown type", "transaction_id,type,amount,settled_at\nTRX-1,chargeback,10,2026-10-02\n", "line 2.type"},
+		{"transaction ID too long", "transaction_id,amount,settled_at\n" + strings.Repeat("X", 51) + ",10,2026-10-02\n", "line 2.transaction_id"},
+		{"bad date", "transaction_id,amount,settled_at\nTRX-1,10,02.10.2026\n", "line 2.settled_at"},
+	}
+	for _, tt := range tests {
+		_, fields := parseSettlementFile("csv", strings.NewReader(tt.csv))
+		if len(fields) != 1 || fields[0].Field != tt.field {
+			t.Errorf("%s: errors = %+v, want one on %s", tt.name, fields, tt.field)
+		}
+	}
+}
+
+func TestMatchSettlement(t *testing.T) {
+	kzt := func(minor int64) types.Money { return types.NewMoney(minor, types.KZT) }
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	captured := day(1).Add(15 * time.Hour)
+	payment := func(id, status string, amount types.Money) *Payment {
+		return &Payment{TransactionID: id, Amount: amount, Currency: amount.Currency(), Status: status, PaymentTime: captured}
+	}
+	partial := kzt(4000)
+	ledger := settlementLedger{
+		Payments: map[string]*Payment{
+			"OK":       payment("OK", paymentStatusSuccess, kzt(10000)),
+			"LATE":     payment("LATE", paymentStatusSuccess, kzt(10000)),
+			"SHORT":    payment("SHORT", paymentStatusSuccess, kzt(10000)),
+			"FAILED":   payment("FAILED", paymentStatusFailed, kzt(10000)),
+			"PENDING":  payment("PENDING", paymentStatusPending, kzt(10000)),
+			"REFUNDED": payment("REFUNDED", paymentStatusSuccess, kzt(10000)),
+			"REVERSED": payment("REVERSED", paymentStatusReversed, kzt(10000)),
+			"PARTIAL":  payment("PARTIAL", paymentStatusReversed, kzt(10000)),
+		},
+		Refunds: map[string]recordedRefunds{
+			"REFUNDED": {Total: kzt(3000), LastAt: day(5)},
+			"REVERSED": {Total: kzt(2500), LastAt: day(2)},
+		},
+		Reversals: map[string]recordedReversal{
+			"REVERSED": {At: day(6)},
+			"PARTIAL":  {At: day(6), Amount: &partial},
+		},
+	}
+	item := func(id, kind string, minor int64, settled int) SettlementItem {
+		return SettlementItem{TransactionID: id, Type: kind, Amount: kzt(minor), SettledOn: day(settled)}
+	}
+	tests := []struct {
+		item     SettlementItem
+		want     string
+		recorded int64
+	}{
+		{item("OK", settlementPayment, 10000, 2), reconciliationMatched, 10000},
+		{item("LATE", settlementPayment, 10000, 9), reconciliationDateMismatch, 10000},
+		{item("SHORT", settlementPayment, 9000, 2), reconciliationAmountMismatch, 10000},
+		{item("FAILED", settlementPayment, 10000, 2), reconciliationSettledButFailed, 10000},
+		{item("PENDING", settlementPayment, 10000, 2), reconciliationMissingInDB, 10000},
+		{item("UNKNOWN", settlementPayment, 10000, 2), reconciliationMissingInDB, -1},
+		{item("REFUNDED", settlementPayment, 10000, 2), reconciliationMatched, 10000},
+		{item("REFUNDED", settlementRefund, 3000, 6), reconciliationMatched, 3000},
+		{item("REFUNDED", settlementRefund, 2000, 6), reconciliationAmountMismatch, 3000},
+		{item("OK", settlementRefund, 1000, 2), reconciliationMissingInDB, -1},
+		{item("REVERSED", settlementReversal, 7500, 7), reconciliationMatched, 7500},
+		{item("REVERSED", settlementReversal, 10000, 7), reconciliationAmountMismatch, 7500},
+		{item("PARTIAL", settlementReversal, 4000, 7), reconciliationMatched, 4000},
+		{item("OK", settlementReversal, 10000, 2), reconciliationMissingInDB, -1},
+	}
+	items := make([]SettlementItem, len(tests))
+	for i, tt := range tests {
+		items[i] = tt.item
+	}
+	results := matchSettlement(items, ledger)
+	for i, tt := range tests {
+		r := results[i]
+		if r.Status != tt.want || r.Type != tt.item.Type {
+			t.Errorf("%s %s: status %s (%s), want %s", tt.item.Type, tt.item.TransactionID, r.Status, r.Note, tt.want)
+		}
+		switch {
+		case tt.recorded < 0 && r.RecordedAmount != nil:
+			t.Errorf("%s %s: recorded %s, want none", tt.item.Type, tt.item.TransactionID, r.RecordedAmount)
+		case tt.recorded >= 0 && (r.RecordedAmount == nil || r.RecordedAmount.Minor() != tt.recorded):
+			t.Errorf("%s %s: recorded %v, want %d", tt.item.Type, tt.item.TransactionID, r.RecordedAmount, tt.recorded)
+		}
+	}
+}
+
+func TestSettlementPeriod(t *testing.T) {
+	at := func(d int) time.Time { return time.Date(2026, 10, d, 12, 0, 0, 0, time.UTC) }
+	payments := map[string]*Payment{
+		"A": {TransactionID: "A", Status: paymentStatusSuccess, PaymentTime: at(3)},
+		"B": {TransactionID: "B", Status: paymentStatusRefunded, PaymentTime: at(1)},
+		"C": {TransactionID: "C", Status: paymentStatusFailed, PaymentTime: at(10)},
+		"D": {TransactionID: "D", Status: paymentStatusSuccess, PaymentTime: at(20)},
+	}
+	items := []SettlementItem{
+		{TransactionID: "A", Type: settlementPayment},
+		{TransactionID: "B", Type: settlementPayment},
+		// Neither failed payments nor refund lines say which captures the file covers
+		{TransactionID: "C", Type: settlementPayment},
+		{TransactionID: "D", Type: settlementRefund},
+		{TransactionID: "UNKNOWN", Type: settlementPayment},
+	}
+	from, to := settlementPeriod(items, payments)
+	if from.Format(rateDateLayout) != "2026-10-01" || to.Format(rateDateLayout) != "2026-10-03" {
+		t.Errorf("period = %s to %s, want 2026-10-01 to 2026-10-03", from.Format(rateDateLayout), to.Format(rateDateLayout))
+	}
+
+	from, to = settlementPeriod(items[2:], payments)
+	if !from.IsZero() || !to.IsZero() {
+		t.Errorf("period of a file settling no captures = %s to %s, want none", from, to)
+	}
+}
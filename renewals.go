@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// How long a single renewal may take to be priced, recorded and queued
+const renewalTimeout = 30 * time.Second
+
+// Start the background loop that charges subscriptions whose period has run out.
+// RENEWAL_POLL_INTERVAL sets how often it looks for them.
+func startRenewalScheduler() {
+	interval := envDuration("RENEWAL_POLL_INTERVAL", time.Hour)
+	goBackground(func(stop context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-ticker.C:
+				renewDueSubscriptions(stop)
+			}
+		}
+	})
+	log.Printf("Started renewal scheduler polling every %s", interval)
+}
+
+// Renew every due subscription the way the admin renewal endpoint does. Instances running this at
+// the same time are safe: each period's renewal has a single reserved transaction ID, so only one
+// of them gets to charge it.
+func renewDueSubscriptions(ctx context.Context) {
+	due, err := listDueRenewals(ctx, time.Now())
+	if err != nil {
+		logFrom(ctx).Error("Error listing due renewals", "error", err)
+		return
+	}
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		runRenewal(ctx, d)
+	}
+}
+
+func runRenewal(ctx context.Context, d dueRenewal) {
+	logger := logFrom(ctx).With("customer_id", d.CustomerID, "subscription_type", d.SubscriptionType)
+
+	// A renewal that has started is allowed to finish during shutdown
+	renewCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), renewalTimeout)
+	defer cancel()
+	accepted, err := renewSubscription(withLogger(renewCtx, logger), d.CustomerID, d.SubscriptionType, d.Currency, d.PeriodStart, "")
+	if err != nil {
+		logger.Warn("Subscription not renewed", "error", err)
+		return
+	}
+	logger.Info("Subscription renewal accepted", "transaction_id", accepted.TransactionID, "status", accepted.Status)
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // Asia/Almaty must resolve on hosts without a zoneinfo database
+
+	"sportlife/types"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Accounting closes days and months on Almaty time. payment_time and the other timestamps the
+// reports read hold UTC.
+const reportTimeZone = "Asia/Almaty"
+
+var reportLocation = mustLoadLocation(reportTimeZone)
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+const (
+	reportPeriodDay   = "day"
+	reportPeriodMonth = "month"
+)
+
+const (
+	reportFormatJSON = "json"
+	reportFormatCSV  = "csv"
+	reportFormatXLSX = "xlsx"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// Longest ranges a report may cover, so a daily report stays a readable size
+const (
+	maxDailyReportDays = 366
+	maxReportYears     = 5
+)
+
+// Kinds of money movement a report is built from
+const (
+	reportEntryPayment  = "payment"
+	reportEntryRefund   = "refund"
+	reportEntryReversal = "reversal"
+)
+
+// Money taken and given back over a period in one currency. Revenue is what was captured in the
+// period, Refunded what was refunded or reversed in it, whenever the payment was taken.
+type RevenueRow struct {
+	// YYYY-MM-DD for daily reports, YYYY-MM for monthly ones
+	Period           string         `json:"period"`
+	Currency         types.Currency `json:"currency"`
+	SubscriptionType string         `json:"subscriptionType,omitempty"`
+	PaymentMethod    string         `json:"paymentMethod,omitempty"`
+	Payments         int            `json:"payments"`
+	Revenue          types.Money    `json:"revenue"`
+	Refunds          int            `json:"refunds"`
+	Refunded         types.Money    `json:"refunded"`
+	Net              types.Money    `json:"net"`
+}
+
+type RevenueReport struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Period   string `json:"period"`
+	TimeZone string `json:"timeZone"`
+	// One row per period and currency
+	Totals             []RevenueRow `json:"totals"`
+	BySubscriptionType []RevenueRow `json:"bySubscriptionType"`
+	ByPaymentMethod    []RevenueRow `json:"byPaymentMethod"`
+}
+
+// A payment, refund or reversal on a customer's statement. Refunds and reversals are negative.
+type StatementLine struct {
+	Time             time.Time      `json:"time"`
+	Date             string         `json:"date"`
+	Kind             string         `json:"kind"`
+	TransactionID    string         `json:"transactionId"`
+	SubscriptionType string         `json:"subscriptionType"`
+	PaymentMethod    string         `json:"paymentMethod"`
+	CardLastFour     string         `json:"cardLastFour"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	Description      string         `json:"description,omitempty"`
+}
+
+type StatementTotal struct {
+	Currency types.Currency `json:"currency"`
+	Paid     types.Money    `json:"paid"`
+	Refunded types.Money    `json:"refunded"`
+	Net      types.Money    `json:"net"`
+}
+
+type CustomerStatement struct {
+	Customer types.Customer   `json:"customer"`
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	TimeZone string           `json:"timeZone"`
+	Lines    []StatementLine  `json:"lines"`
+	Totals   []StatementTotal `json:"totals"`
+}
+
+// Date range and output format of a report request
+type reportRequest struct {
+	From, To time.Time
+	Format   string
+}
+
+// Read from, to and format. Dates are Almaty days, to inclusive; to defaults to today and from
+// to the first day of to's month for daily reports, of its year otherwise.
+func parseReportRequest(r *http.Request, daily bool) (reportRequest, []types.FieldError) {
+	var req reportRequest
+	var fields []types.FieldError
+	query := r.URL.Query()
+
+	req.Format = query.Get("format")
+	switch req.Format {
+	case "":
+		req.Format = reportFormatJSON
+	case reportFormatJSON, reportFormatCSV, reportFormatXLSX:
+	default:
+		fields = append(fields, types.FieldError{Field: "format", Message: "must be one of json, csv, xlsx"})
+	}
+
+	now := time.Now().In(reportLocation)
+	req.To = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, reportLocation)
+	if v := query.Get("to"); v != "" {
+		day, err := time.ParseInLocation(rateDateLayout, v, reportLocation)
+		if err != nil {
+			fields = append(fields, types.FieldError{Field: "to", Message: "must be a date like 2026-01-31"})
+		}
+		req.To = day
+	}
+	req.From = time.Date(req.To.Year(), 1, 1, 0, 0, 0, 0, reportLocation)
+	if daily {
+		req.From = time.Date(req.To.Year(), req.To.Month(), 1, 0, 0, 0, 0, reportLocation)
+	}
+	if v := query.Get("from"); v != "" {
+		day, err := time.ParseInLocation(rateDateLayout, v, reportLocation)
+		if err != nil {
+			fields = append(fields, types.FieldError{Field: "from", Message: "must be a date like 2026-01-31"})
+		}
+		req.From = day
+	}
+	if len(fields) > 0 {
+		return req, fields
+	}
+
+	switch {
+	case req.To.Before(req.From):
+		fields = append(fields, types.FieldError{Field: "to", Message: "must not be before from"})
+	case daily && req.end().After(req.From.AddDate(0, 0, maxDailyReportDays)):
+		fields = append(fields, types.FieldError{Field: "to", Message: fmt.Sprintf("must be less than %d days after from for a daily report", maxDailyReportDays)})
+	case req.end().After(req.From.AddDate(maxReportYears, 0, 0)):
+		fields = append(fields, types.FieldError{Field: "to", Message: fmt.Sprintf("must be less than %d years after from", maxReportYears)})
+	}
+	return req, fields
+}
+
+// Start of the day after To, where the report's range ends
+func (req reportRequest) end() time.Time {
+	return req.To.AddDate(0, 0, 1)
+}
+
+func (req reportRequest) fileName(name string) string {
+	return fmt.Sprintf("%s_%s_%s.%s", name, req.From.Format(rateDateLayout), req.To.Format(rateDateLayout), req.Format)
+}
+
+func handleRevenueReport(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = reportPeriodDay
+	}
+	var fields []types.FieldError
+	if period != reportPeriodDay && period != reportPeriodMonth {
+		fields = append(fields, types.FieldError{Field: "period", Message: "must be day or month"})
+	}
+	req, reqFields := parseReportRequest(r, period == reportPeriodDay)
+	if fields = append(fields, reqFields...); len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid report", fields...)
+		return
+	}
+
+	rows, err := listRevenueRows(r.Context(), period, req.From, req.end())
+	if err != nil {
+		logFrom(r.Context()).Error("Error building revenue report", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error building revenue report")
+		return
+	}
+	report := RevenueReport{
+		From:     req.From.Format(rateDateLayout),
+		To:       req.To.Format(rateDateLayout),
+		Period:   period,
+		TimeZone: reportTimeZone,
+	}
+	report.Totals, err = rollUpRevenue(rows, false, false)
+	if err == nil {
+		report.BySubscriptionType, err = rollUpRevenue(rows, true, false)
+	}
+	if err == nil {
+		report.ByPaymentMethod, err = rollUpRevenue(rows, false, true)
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error totalling revenue report", "error", err)
+		writeError(w, r, types.ErrCodeInternal, "Error building revenue report")
+		return
+	}
+	writeReport(w, r, req, "revenue", report)
+}
+
+func handleCustomerStatement(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	req, fields := parseReportRequest(r, false)
+	if len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid statement", fields...)
+		return
+	}
+
+	customer, err := getCustomer(r.Context(), customerID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Customer not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading customer", "customer_id", customerID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading customer")
+		return
+	}
+	lines, err := listStatementLines(r.Context(), customerID, req.From, req.end())
+	if err != nil {
+		logFrom(r.Context()).Error("Error building customer statement", "customer_id", customerID, "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error building customer statement")
+		return
+	}
+	totals, err := statementTotals(lines)
+	if err != nil {
+		logFrom(r.Context()).Error("Error totalling customer statement", "customer_id", customerID, "error", err)
+		writeError(w, r, types.ErrCodeInternal, "Error building customer statement")
+		return
+	}
+	statement := CustomerStatement{
+		Customer: *customer,
+		From:     req.From.Format(rateDateLayout),
+		To:       req.To.Format(rateDateLayout),
+		TimeZone: reportTimeZone,
+		Lines:    lines,
+		Totals:   totals,
+	}
+	writeReport(w, r, req, fmt.Sprintf("statement_%d", customerID), statement)
+}
+
+// Sum rows keyed by period, currency, subscription type and payment method into rows keyed by
+// period, currency and whichever of the two are kept
+func rollUpRevenue(rows []RevenueRow, bySubscriptionType, byPaymentMethod bool) ([]RevenueRow, error) {
+	type key struct {
+		period, subscriptionType, paymentMethod string
+		currency                                types.Currency
+	}
+	sums := make(map[key]*RevenueRow)
+	var order []key
+	for _, row := range rows {
+		k := key{period: row.Period, currency: row.Currency}
+		if bySubscriptionType {
+			k.subscriptionType = row.SubscriptionType
+		}
+		if byPaymentMethod {
+			k.paymentMethod = row.PaymentMethod
+		}
+		sum, ok := sums[k]
+		if !ok {
+			zero := types.Zero(row.Currency)
+			sum = &RevenueRow{Period: k.period, Currency: k.currency, SubscriptionType: k.subscriptionType, PaymentMethod: k.paymentMethod,
+				Revenue: zero, Refunded: zero, Net: zero}
+			sums[k] = sum
+			order = append(order, k)
+		}
+		sum.Payments += row.Payments
+		sum.Refunds += row.Refunds
+		var err error
+		if sum.Revenue, err = sum.Revenue.Add(row.Revenue); err != nil {
+			return nil, err
+		}
+		if sum.Refunded, err = sum.Refunded.Add(row.Refunded); err != nil {
+			return nil, err
+		}
+		if sum.Net, err = sum.Revenue.Sub(sum.Refunded); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]RevenueRow, len(order))
+	for i, k := range order {
+		result[i] = *sums[k]
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if a.Currency != b.Currency {
+			return a.Currency < b.Currency
+		}
+		if a.SubscriptionType != b.SubscriptionType {
+			return a.SubscriptionType < b.SubscriptionType
+		}
+		return a.PaymentMethod < b.PaymentMethod
+	})
+	return result, nil
+}
+
+// Paid, refunded and net amounts of statement lines, per currency
+func statementTotals(lines []StatementLine) ([]StatementTotal, error) {
+	totals := []StatementTotal{}
+	index := make(map[types.Currency]int)
+	for _, line := range lines {
+		i, ok := index[line.Currency]
+		if !ok {
+			zero := types.Zero(line.Currency)
+			i = len(totals)
+			index[line.Currency] = i
+			totals = append(totals, StatementTotal{Currency: line.Currency, Paid: zero, Refunded: zero, Net: zero})
+		}
+		t := &totals[i]
+		var err error
+		if line.Amount.IsNegative() {
+			t.Refunded, err = t.Refunded.Sub(line.Amount)
+		} else {
+			t.Paid, err = t.Paid.Add(line.Amount)
+		}
+		if err == nil {
+			t.Net, err = t.Paid.Sub(t.Refunded)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Currency < totals[j].Currency })
+	return totals, nil
+}
+
+// A table of a report as it is exported: a CSV file or a worksheet
+type reportSheet struct {
+	Name   string
+	Header []string
+	// Cells are strings, ints or types.Money
+	Rows [][]interface{}
+}
+
+// A report that can be downloaded as a CSV file or an XLSX workbook as well as read as JSON
+type exportableReport interface {
+	csvSheet() reportSheet
+	xlsxSheets() []reportSheet
+}
+
+var revenueHeader = []string{"period", "currency", "subscription_type", "payment_method", "payments", "revenue", "refunds", "refunded", "net"}
+
+func revenueRows(rows []RevenueRow) [][]interface{} {
+	cells := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		cells[i] = []interface{}{row.Period, string(row.Currency), row.SubscriptionType, row.PaymentMethod,
+			row.Payments, row.Revenue, row.Refunds, row.Refunded, row.Net}
+	}
+	return cells
+}
+
+// The totals and both breakdowns in one table, told apart by the breakdown column
+func (report RevenueReport) csvSheet() reportSheet {
+	sheet := reportSheet{Name: "Revenue", Header: append([]string{"breakdown"}, revenueHeader...)}
+	sections := []struct {
+		name string
+		rows []RevenueRow
+	}{
+		{"total", report.Totals},
+		{"subscription_type", report.BySubscriptionType},
+		{"payment_method", report.ByPaymentMethod},
+	}
+	for _, section := range sections {
+		for _, row := range revenueRows(section.rows) {
+			sheet.Rows = append(sheet.Rows, append([]interface{}{section.name}, row...))
+		}
+	}
+	return sheet
+}
+
+func (report RevenueReport) xlsxSheets() []reportSheet {
+	return []reportSheet{
+		{Name: "Totals", Header: revenueHeader, Rows: revenueRows(report.Totals)},
+		{Name: "By subscription type", Header: revenueHeader, Rows: revenueRows(report.BySubscriptionType)},
+		{Name: "By payment method", Header: revenueHeader, Rows: revenueRows(report.ByPaymentMethod)},
+	}
+}
+
+func (statement CustomerStatement) csvSheet() reportSheet {
+	sheet := reportSheet{
+		Name:   "Statement",
+		Header: []string{"date", "kind", "transaction_id", "subscription_type", "payment_method", "card_last_four", "amount", "currency", "description"},
+	}
+	for _, line := range statement.Lines {
+		sheet.Rows = append(sheet.Rows, []interface{}{line.Date, line.Kind, line.TransactionID, line.SubscriptionType, line.PaymentMethod,
+			line.CardLastFour, line.Amount, string(line.Currency), line.Description})
+	}
+	return sheet
+}
+
+func (statement CustomerStatement) xlsxSheets() []reportSheet {
+	totals := reportSheet{Name: "Totals", Header: []string{"currency", "paid", "refunded", "net"}}
+	for _, t := range statement.Totals {
+		totals.Rows = append(totals.Rows, []interface{}{string(t.Currency), t.Paid, t.Refunded, t.Net})
+	}
+	return []reportSheet{statement.csvSheet(), totals}
+}
+
+// Write a report as JSON or export it in the requested format
+func writeReport(w http.ResponseWriter, r *http.Request, req reportRequest, name string, report exportableReport) {
+	var err error
+	switch req.Format {
+	case reportFormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+req.fileName(name)+`"`)
+		err = writeCSVSheet(w, report.csvSheet())
+	case reportFormatXLSX:
+		w.Header().Set("Content-Type", xlsxContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+req.fileName(name)+`"`)
+		err = writeXLSX(w, report.xlsxSheets())
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+	if err != nil {
+		// The headers are gone by now, so all that is left is to log the broken download
+		logFrom(r.Context()).Error("Error writing report", "report", name, "format", req.Format, "error", err)
+	}
+}
+
+func writeCSVSheet(w io.Writer, sheet reportSheet) error {
+	out := csv.NewWriter(w)
+	out.Write(sheet.Header)
+	for _, row := range sheet.Rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			switch v := cell.(type) {
+			case types.Money:
+				record[i] = v.Decimal()
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func writeXLSX(w io.Writer, sheets []reportSheet) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	amountStyles := make(map[int]int)
+	for i, sheet := range sheets {
+		if i == 0 {
+			if err := f.SetSheetName("Sheet1", sheet.Name); err != nil {
+				return err
+			}
+		} else if _, err := f.NewSheet(sheet.Name); err != nil {
+			return err
+		}
+		for col, title := range sheet.Header {
+			cell, _ := excelize.CoordinatesToCellName(col+1, 1)
+			f.SetCellValue(sheet.Name, cell, title)
+			f.SetCellStyle(sheet.Name, cell, cell, bold)
+		}
+		for n, row := range sheet.Rows {
+			for col, value := range row {
+				cell, _ := excelize.CoordinatesToCellName(col+1, n+2)
+				m, ok := value.(types.Money)
+				if !ok {
+					f.SetCellValue(sheet.Name, cell, value)
+					continue
+				}
+				// Amounts are numbers shown with their currency's minor digits, so they can be summed
+				digits := m.Currency().Digits()
+				style, ok := amountStyles[digits]
+				if !ok {
+					format := "#,##0"
+					if digits > 0 {
+						format += "." + strings.Repeat("0", digits)
+					}
+					if style, err = f.NewStyle(&excelize.Style{CustomNumFmt: &format}); err != nil {
+						return err
+					}
+					amountStyles[digits] = style
+				}
+				f.SetCellValue(sheet.Name, cell, m.Float64())
+				f.SetCellStyle(sheet.Name, cell, cell, style)
+			}
+		}
+		f.SetPanes(sheet.Name, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+	}
+	_, err = f.WriteTo(w)
+	return err
+}
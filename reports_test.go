@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"sportlife/types"
+)
+
+func TestRollUpRevenue(t *testing.T) {
+	kzt := func(minor int64) types.Money { return types.NewMoney(minor, types.KZT) }
+	row := func(period, subscriptionType, method string, payments int, revenue, refunded types.Money) RevenueRow {
+		net, _ := revenue.Sub(refunded)
+		return RevenueRow{Period: period, Currency: revenue.Currency(), SubscriptionType: subscriptionType, PaymentMethod: method,
+			Payments: payments, Revenue: revenue, Refunds: 1, Refunded: refunded, Net: net}
+	}
+	rows := []RevenueRow{
+		row("2026-10-02", "Premium", "Credit Card", 2, kzt(20000), kzt(5000)),
+		row("2026-10-01", "Premium", "Credit Card", 1, kzt(10000), kzt(0)),
+		row("2026-10-01", "Basic", "Credit Card", 3, kzt(15000), kzt(1000)),
+		row("2026-10-01", "Basic", "Saved Card", 1, kzt(5000), kzt(0)),
+		row("2026-10-01", "Premium", "Credit Card", 1, types.NewMoney(2000, types.USD), types.Zero(types.USD)),
+	}
+
+	got, err := rollUpRevenue(rows, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		period                 string
+		currency               types.Currency
+		payments               int
+		revenue, refunded, net int64
+	}{
+		{"2026-10-01", types.KZT, 5, 30000, 1000, 29000},
+		{"2026-10-01", types.USD, 1, 2000, 0, 2000},
+		{"2026-10-02", types.KZT, 2, 20000, 5000, 15000},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Period != w.period || g.Currency != w.currency || g.Payments != w.payments ||
+			g.Revenue.Minor() != w.revenue || g.Refunded.Minor() != w.refunded || g.Net.Minor() != w.net {
+			t.Errorf("row %d = %+v, want %+v", i, g, w)
+		}
+		if g.SubscriptionType != "" || g.PaymentMethod != "" {
+			t.Errorf("row %d keeps a breakdown it was not asked for: %+v", i, g)
+		}
+	}
+
+	bySubscription, err := rollUpRevenue(rows, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bySubscription) != 4 {
+		t.Fatalf("got %d rows by subscription type, want 4: %+v", len(bySubscription), bySubscription)
+	}
+	if b := bySubscription[0]; b.SubscriptionType != "Basic" || b.Payments != 4 || b.Revenue.Minor() != 20000 {
+		t.Errorf("first row by subscription type = %+v, want Basic with 4 payments of 200.00", b)
+	}
+}
+
+func TestRollUpRevenueCurrencyMismatch(t *testing.T) {
+	rows := []RevenueRow{
+		{Period: "2026-10-01", Currency: types.KZT, Revenue: types.NewMoney(1000, types.KZT), Refunded: types.Zero(types.KZT)},
+		{Period: "2026-10-01", Currency: types.KZT, Revenue: types.NewMoney(1000, types.USD), Refunded: types.Zero(types.USD)},
+	}
+	if _, err := rollUpRevenue(rows, false, false); !errors.Is(err, types.ErrCurrencyMismatch) {
+		t.Errorf("error = %v, want ErrCurrencyMismatch", err)
+	}
+}
+
+func TestGatewayTransitionPartialReversal(t *testing.T) {
+	kzt := func(minor int64) types.Money { return types.NewMoney(minor, types.KZT) }
+	event := func(kind string, minor int64, currency types.Currency) gatewayEvent {
+		amount := types.NewMoney(minor, currency)
+		return gatewayEvent{Kind: kind, Amount: &amount, Currency: currency}
+	}
+	tests := []struct {
+		name     string
+		ev       gatewayEvent
+		refunded int64
+		status   string
+		outcome  string
+	}{
+		{"full reversal", event(gatewayEventReversed, 10000, types.KZT), 0, paymentStatusReversed, callbackOutcomeApplied},
+		{"partial reversal", event(gatewayEventReversed, 4000, types.KZT), 0, paymentStatusReversed, callbackOutcomeApplied},
+		{"rest after a refund", event(gatewayEventReversed, 7000, types.KZT), 3000, paymentStatusReversed, callbackOutcomeApplied},
+		{"more than was not refunded", event(gatewayEventReversed, 7500, types.KZT), 3000, "", callbackOutcomeAmountMismatch},
+		{"nothing", event(gatewayEventReversed, 0, types.KZT), 0, "", callbackOutcomeAmountMismatch},
+		{"other currency", event(gatewayEventReversed, 4000, types.USD), 0, "", callbackOutcomeAmountMismatch},
+		{"partial capture", event(gatewayEventCaptured, 4000, types.KZT), 0, "", callbackOutcomeAmountMismatch},
+	}
+	for _, tt := range tests {
+		from := paymentStatusSuccess
+		if tt.ev.Kind == gatewayEventCaptured {
+			from = paymentStatusProcessing
+		}
+		status, outcome := gatewayTransition(tt.ev, from, kzt(10000), kzt(tt.refunded))
+		if status != tt.status || outcome != tt.outcome {
+			t.Errorf("%s: got %q, %q, want %q, %q", tt.name, status, outcome, tt.status, tt.outcome)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"sportlife/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// Build the single router serving the payment API and the cart transaction endpoint
+func newRouter(transactions *TransactionController) *gin.Engine {
+	r := gin.New()
+	// Only trust X-Forwarded-For from configured proxies, otherwise per-IP limits are trivial to dodge
+	r.SetTrustedProxies(trustedProxies())
+	r.Use(otelgin.Middleware(serviceName), requestIDMiddleware(), metricsMiddleware(), accessLogMiddleware(), gin.CustomRecovery(recoverWithError))
+
+	r.NoRoute(func(c *gin.Context) {
+		abortWithError(c, types.ErrCodeNotFound, "Route not found")
+	})
+
+	r.GET("/openapi.json", wrapHandler(serveOpenAPISpec))
+	r.GET("/healthz", wrapHandler(handleHealthz))
+	r.GET("/readyz", wrapHandler(handleReadyz))
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	limiter := newRateLimiterFromEnv(db)
+	limiter.startSweeper()
+
+	v1 := r.Group("/v1")
+	{
+		v1.POST("/init-payment", limiter.middleware(limiter.ip), wrapHandler(handleInitPayment))
+		v1.GET("/payment", wrapHandler(servePaymentPage))
+		v1.POST("/process-payment", authOptional(), limiter.middleware(limiter.ip, limiter.email, limiter.card), wrapHandler(handleProcessPayment))
+		v1.POST("/checkout", authOptional(), limiter.middleware(limiter.ip, limiter.email, limiter.card), wrapHandler(handleCheckout))
+		v1.GET("/payments/:id/status", wrapHandler(handleGetPaymentStatus))
+		v1.GET("/payments/:id/events", wrapHandler(handlePaymentEvents))
+		v1.POST("/payments/:id/3ds/callback", wrapHandler(handleChallengeCallback))
+		v1.POST("/gateway/callbacks/:provider", wrapHandler(handleGatewayCallback))
+
+		// Stand-in for the issuer's challenge pages while payments go through the simulated gateway.
+		// Not part of the API contract, so it is left out of openapi.json.
+		if sim, ok := gateway.(*simulatedGateway); ok {
+			simulator := threeDSSimulator{gateway: sim}
+			v1.GET("/3ds-simulator/challenges/:id", wrapHandler(simulator.handleChallengePage))
+			v1.POST("/3ds-simulator/challenges/:id", wrapHandler(simulator.handleChallengeAnswer))
+		}
+
+		authed := v1.Group("", authRequired())
+		authed.GET("/payments/:id", adminRequired(), wrapHandler(handleGetPayment))
+		authed.POST("/payments/:id/refund", adminRequired(), wrapHandler(handleRefundPayment))
+		authed.POST("/carts/:cart_id/transactions", transactions.ProcessTransaction)
+		authed.GET("/me/payments", wrapHandler(handleListMyPayments))
+		authed.GET("/me/payments/:id/receipt", wrapHandler(handleGetMyReceipt))
+		authed.GET("/me/payment-methods", wrapHandler(handleListMyPaymentMethods))
+		authed.DELETE("/me/payment-methods/:id", wrapHandler(handleDeleteMyPaymentMethod))
+		authed.POST("/me/payment-methods/:id/default", wrapHandler(handleSetDefaultPaymentMethod))
+
+		admin := authed.Group("/admin", adminRequired())
+		admin.GET("/fraud-reviews", wrapHandler(handleListFraudReviews))
+		admin.POST("/fraud-reviews/:id/approve", wrapHandler(handleApproveFraudReview))
+		admin.POST("/fraud-reviews/:id/reject", wrapHandler(handleRejectFraudReview))
+		admin.POST("/webhooks", wrapHandler(handleCreateWebhook))
+		admin.GET("/webhooks", wrapHandler(handleListWebhooks))
+		admin.DELETE("/webhooks/:id", wrapHandler(handleDeleteWebhook))
+		admin.GET("/webhooks/:id/deliveries", wrapHandler(handleListWebhookDeliveries))
+		admin.GET("/webhook-deliveries/:id", wrapHandler(handleGetWebhookDelivery))
+		admin.POST("/webhook-deliveries/:id/redeliver", wrapHandler(handleRedeliverWebhook))
+		admin.POST("/promo-codes", wrapHandler(handleCreatePromoCode))
+		admin.GET("/promo-codes", wrapHandler(handleListPromoCodes))
+		admin.POST("/customers/:id/renewals", wrapHandler(handleRenewSubscription))
+		admin.GET("/exchange-rates", wrapHandler(handleListExchangeRates))
+		admin.POST("/exchange-rates", wrapHandler(handleSetExchangeRates))
+		admin.POST("/reconciliations", wrapHandler(handleCreateReconciliation))
+		admin.GET("/reconciliations", wrapHandler(handleListReconciliations))
+		admin.GET("/reconciliations/:id", wrapHandler(handleGetReconciliation))
+		admin.GET("/reports/revenue", wrapHandler(handleRevenueReport))
+		admin.GET("/reports/customers/:id/statement", wrapHandler(handleCustomerStatement))
+	}
+
+	// The unversioned paths served before /v1 keep working for existing integrations until they move
+	legacy := r.Group("", deprecatedAlias("/v1"))
+	{
+		legacy.POST("/init-payment", limiter.middleware(limiter.ip), wrapHandler(handleInitPayment))
+		legacy.GET("/payment", wrapHandler(servePaymentPage))
+		legacy.POST("/process-payment", authOptional(), limiter.middleware(limiter.ip, limiter.email, limiter.card), wrapHandler(handleProcessPayment))
+		legacy.GET("/payments/:id", authRequired(), adminRequired(), wrapHandler(handleGetPayment))
+		legacy.POST("/payments/:id/refund", authRequired(), adminRequired(), wrapHandler(handleRefundPayment))
+	}
+
+	return r
+}
+
+// Mark responses of a deprecated path and point callers at its replacement under prefix
+func deprecatedAlias(prefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+prefix+c.Request.URL.Path+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
+
+// Proxies allowed to set X-Forwarded-For: loopback, where the cart checkout calls the payment API
+// from on behalf of its customer, and the comma-separated TRUSTED_PROXIES
+func trustedProxies() []string {
+	proxies := []string{"127.0.0.1", "::1"}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		proxies = append(proxies, strings.Split(v, ",")...)
+	}
+	return proxies
+}
+
+// Adapt a net/http handler to gin, exposing gin's path params through r.PathValue
+// and the caller's IP and authenticated user through clientIP and userID
+func wrapHandler(h http.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, p := range c.Params {
+			c.Request.SetPathValue(p.Key, p.Value)
+		}
+		ctx := context.WithValue(c.Request.Context(), clientIPKey{}, c.ClientIP())
+		ctx = context.WithValue(ctx, userIDKey{}, c.GetString("userID"))
+		ctx = context.WithValue(ctx, userEmailKey{}, c.GetString("email"))
+		h(c.Writer, c.Request.WithContext(ctx))
+	}
+}
+
+type clientIPKey struct{}
+
+type userIDKey struct{}
+
+type userEmailKey struct{}
+
+// The caller's IP address for a request served through wrapHandler
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// The authenticated user's ID for a request served through wrapHandler, or "" if unauthenticated
+func userID(ctx context.Context) string {
+	id, _ := ctx.Value(userIDKey{}).(string)
+	return id
+}
+
+// The email claim of the authenticated user's token, or "" if it has none
+func userEmail(ctx context.Context) string {
+	email, _ := ctx.Value(userEmailKey{}).(string)
+	return email
+}
+
+// Make sure every request carries an ID, echo it back to the caller and tag the request's logger with it
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := requestID(c.Request)
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(withLogger(c.Request.Context(), slog.Default().With("request_id", id)))
+		c.Next()
+	}
+}
+
+// Reply with the error envelope instead of gin's bare 500 when a handler panics
+func recoverWithError(c *gin.Context, err interface{}) {
+	logFrom(c.Request.Context()).Error("panic while serving request", "method", c.Request.Method, "path", c.Request.URL.Path, "panic", err)
+	abortWithError(c, types.ErrCodeInternal, "Internal server error")
+}
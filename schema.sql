@@ -18,4 +18,325 @@ CREATE TABLE subscription_receipts (
     receipt_path VARCHAR(255) NOT NULL,
     email_status VARCHAR(20) NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-); 
\ No newline at end of file
+); 
+CREATE TABLE payment_refunds (
+    id SERIAL PRIMARY KEY,
+    transaction_id VARCHAR(50) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX payment_transactions_transaction_id_key ON payment_transactions (transaction_id);
+
+CREATE TABLE rate_limit_buckets (
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+ALTER TABLE payment_transactions
+    ADD COLUMN card_fingerprint VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN client_ip VARCHAR(45) NOT NULL DEFAULT '',
+    ADD COLUMN fraud_score INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN fraud_decision VARCHAR(10) NOT NULL DEFAULT 'allow',
+    ADD COLUMN fraud_reasons TEXT NOT NULL DEFAULT '',
+    ADD COLUMN fraud_review_status VARCHAR(10),
+    ADD COLUMN fraud_reviewed_by VARCHAR(255),
+    ADD COLUMN fraud_reviewed_at TIMESTAMP;
+
+CREATE INDEX payment_transactions_card_fingerprint_idx ON payment_transactions (card_fingerprint, payment_time);
+CREATE INDEX payment_transactions_customer_email_idx ON payment_transactions (lower(customer_email), payment_time);
+CREATE INDEX payment_transactions_client_ip_idx ON payment_transactions (client_ip, payment_time);
+CREATE INDEX payment_transactions_fraud_review_idx ON payment_transactions (fraud_review_status) WHERE fraud_review_status IS NOT NULL;
+
+CREATE TABLE webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id),
+    event_id VARCHAR(50) NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP,
+    delivered_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
+
+CREATE TABLE webhook_delivery_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries (id),
+    attempted_at TIMESTAMP NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    response_body TEXT NOT NULL DEFAULT '',
+    duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_delivery_attempts_delivery_idx ON webhook_delivery_attempts (delivery_id, attempted_at);
+
+-- Every verified gateway callback, kept verbatim for audit
+CREATE TABLE gateway_callback_events (
+    id BIGSERIAL PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_kind VARCHAR(20) NOT NULL DEFAULT '',
+    transaction_id VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    outcome VARCHAR(30),
+    received_at TIMESTAMP NOT NULL,
+    processed_at TIMESTAMP,
+    UNIQUE (provider, event_id)
+);
+
+CREATE INDEX gateway_callback_events_transaction_idx ON gateway_callback_events (transaction_id);
+
+-- Items sold through /checkout; prices here are the only ones a cart payment is charged
+CREATE TABLE catalog_items (
+    id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    price DECIMAL(10,2) NOT NULL CHECK (price > 0),
+    active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE payment_line_items (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id VARCHAR(50) NOT NULL REFERENCES payment_transactions (transaction_id),
+    position INTEGER NOT NULL,
+    item_id VARCHAR(50) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    unit_price DECIMAL(10,2) NOT NULL,
+    quantity INTEGER NOT NULL,
+    total DECIMAL(10,2) NOT NULL,
+    UNIQUE (transaction_id, position)
+);
+
+CREATE TABLE promo_codes (
+    code VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    discount_type VARCHAR(10) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value DECIMAL(10,2) NOT NULL,
+    -- Comma-separated subscription types; empty applies to every plan
+    plans TEXT NOT NULL DEFAULT '',
+    valid_from TIMESTAMP NOT NULL,
+    valid_until TIMESTAMP,
+    max_redemptions INTEGER,
+    max_per_customer INTEGER,
+    first_purchase_only BOOLEAN NOT NULL DEFAULT FALSE,
+    redemptions INTEGER NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE promo_redemptions (
+    id BIGSERIAL PRIMARY KEY,
+    code VARCHAR(50) NOT NULL REFERENCES promo_codes (code),
+    transaction_id VARCHAR(50) NOT NULL UNIQUE,
+    customer_email VARCHAR(255) NOT NULL,
+    discount DECIMAL(10,2) NOT NULL,
+    redeemed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX promo_redemptions_customer_idx ON promo_redemptions (code, lower(customer_email));
+
+-- What /init-payment priced, so /process-payment charges the server's amount
+CREATE TABLE payment_intents (
+    transaction_id VARCHAR(50) PRIMARY KEY,
+    subscription_type VARCHAR(50) NOT NULL,
+    base_price DECIMAL(10,2) NOT NULL,
+    promo_code VARCHAR(50) REFERENCES promo_codes (code),
+    discount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    amount DECIMAL(10,2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- VAT included in amount; the breakdown holds the per-line and per-rate figures printed on the receipt
+ALTER TABLE payment_transactions
+    ADD COLUMN net_amount DECIMAL(10,2),
+    ADD COLUMN tax_amount DECIMAL(10,2),
+    ADD COLUMN tax_breakdown JSONB;
+
+-- Amounts are in the currency of their row; base_amount is the amount in the reporting currency
+-- at the exchange rate of the payment day, NULL when no rate was known
+ALTER TABLE payment_transactions
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT',
+    ADD COLUMN base_amount DECIMAL(12,2);
+
+ALTER TABLE payment_refunds ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+ALTER TABLE payment_intents ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+-- Currency of a fixed-amount discount
+ALTER TABLE promo_codes ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+
+-- Plan prices by currency; a plan with no row for a currency is priced by the basePrice sent to /init-payment
+CREATE TABLE plan_prices (
+    subscription_type VARCHAR(50) NOT NULL,
+    currency CHAR(3) NOT NULL,
+    price DECIMAL(10,2) NOT NULL CHECK (price > 0),
+    PRIMARY KEY (subscription_type, currency)
+);
+
+-- Units of the reporting currency per unit of currency, effective from effective_date
+CREATE TABLE exchange_rates (
+    currency CHAR(3) NOT NULL,
+    effective_date DATE NOT NULL,
+    rate DECIMAL(18,8) NOT NULL CHECK (rate > 0),
+    source VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (currency, effective_date)
+);
+
+-- Customers are identified by their normalized email and phone; user_id is the subject of the
+-- login token of a customer who has claimed their account
+CREATE TABLE customers (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(255) UNIQUE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    email VARCHAR(255) NOT NULL,
+    email_normalized VARCHAR(255) NOT NULL UNIQUE,
+    phone VARCHAR(20),
+    phone_normalized VARCHAR(20) UNIQUE,
+    locale VARCHAR(10) NOT NULL DEFAULT 'ru',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE payment_transactions ADD COLUMN customer_id BIGINT REFERENCES customers(id);
+CREATE INDEX idx_payment_transactions_customer ON payment_transactions (customer_id, payment_time DESC);
+
+-- Create customers for payments taken before accounts existed
+INSERT INTO customers (email, email_normalized)
+SELECT DISTINCT ON (LOWER(TRIM(customer_email))) TRIM(customer_email), LOWER(TRIM(customer_email))
+FROM payment_transactions
+ORDER BY LOWER(TRIM(customer_email)), payment_time DESC
+ON CONFLICT (email_normalized) DO NOTHING;
+
+UPDATE payment_transactions SET customer_id = customers.id
+FROM customers WHERE customers.email_normalized = LOWER(TRIM(payment_transactions.customer_email));
+
+-- Cards customers saved for later payments, stored as the acquirer's token. A customer has at most
+-- one default card, the one renewals are charged to.
+CREATE TABLE payment_methods (
+    id BIGSERIAL PRIMARY KEY,
+    customer_id BIGINT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    brand VARCHAR(20) NOT NULL,
+    last_four VARCHAR(4) NOT NULL,
+    exp_month SMALLINT NOT NULL CHECK (exp_month BETWEEN 1 AND 12),
+    exp_year SMALLINT NOT NULL,
+    token VARCHAR(255) NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    bin VARCHAR(8) NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (customer_id, fingerprint)
+);
+
+CREATE UNIQUE INDEX idx_payment_methods_default ON payment_methods (customer_id) WHERE is_default;
+
+-- Settlement files reconciled against payment_transactions, with the outcome counts of their items
+CREATE TABLE reconciliations (
+    id BIGSERIAL PRIMARY KEY,
+    source VARCHAR(255) NOT NULL,
+    format VARCHAR(10) NOT NULL,
+    -- Capture dates of the payments the file was expected to settle; NULL when it matched none
+    period_from DATE,
+    period_to DATE,
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    matched INTEGER NOT NULL DEFAULT 0,
+    missing_in_db INTEGER NOT NULL DEFAULT 0,
+    missing_in_settlement INTEGER NOT NULL DEFAULT 0,
+    amount_mismatch INTEGER NOT NULL DEFAULT 0,
+    date_mismatch INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE reconciliation_items (
+    id BIGSERIAL PRIMARY KEY,
+    reconciliation_id BIGINT NOT NULL REFERENCES reconciliations(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    status VARCHAR(30) NOT NULL,
+    transaction_id VARCHAR(50) NOT NULL,
+    settled_amount DECIMAL(14,2),
+    settled_currency CHAR(3),
+    settled_on DATE,
+    recorded_amount DECIMAL(14,2),
+    recorded_currency CHAR(3),
+    payment_status VARCHAR(20),
+    payment_time TIMESTAMP,
+    note TEXT NOT NULL DEFAULT '',
+    UNIQUE (reconciliation_id, position)
+);
+
+-- Status and event streams of a payment are only served to whoever holds its status token, of
+-- which only the SHA-256 is kept
+ALTER TABLE payment_transactions ADD COLUMN status_token_hash CHAR(64);
+
+-- Page the cardholder was sent to while a payment waits for 3-D Secure, for status reads served
+-- by an instance that did not issue the challenge
+ALTER TABLE payment_transactions ADD COLUMN challenge_url TEXT;
+
+-- Payments made for cart transactions, so a cart transaction can be settled when its payment
+-- finishes after the checkout request has returned, as it does after a 3-D Secure challenge
+CREATE TABLE cart_payments (
+    cart_transaction_id BIGINT PRIMARY KEY,
+    payment_transaction_id VARCHAR(50) NOT NULL UNIQUE REFERENCES payment_transactions (transaction_id)
+);
+
+-- /checkout prices carts from the cart service's cart_items instead
+DROP TABLE catalog_items;
+
+-- Redemptions that turned out to be past a code's caps once the discounted payment had been charged
+ALTER TABLE promo_redemptions ADD COLUMN over_limit BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Discounts are held exactly: hundredths of a percent for percentage codes, minor units for fixed ones
+ALTER TABLE promo_codes ALTER COLUMN discount_value TYPE BIGINT USING round(discount_value * 100);
+
+-- Only the six-digit BIN of a saved card is kept, the part of the number that may be stored in the clear
+ALTER TABLE payment_methods ALTER COLUMN bin TYPE VARCHAR(6) USING LEFT(bin, 6);
+
+-- Renewal charges, at most one per customer, plan and billing period, so a renewal that is retried
+-- or run by two instances at once resubmits the same payment instead of charging again
+CREATE TABLE subscription_renewals (
+    customer_id BIGINT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    subscription_type VARCHAR(50) NOT NULL,
+    period_start DATE NOT NULL,
+    transaction_id VARCHAR(50) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (customer_id, subscription_type, period_start)
+);
+
+-- Settlement files carry refund and reversal lines besides payments, and a charge settled for a
+-- payment recorded as failed or declined gets an outcome of its own
+ALTER TABLE reconciliations ADD COLUMN settled_but_failed INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE reconciliation_items ADD COLUMN line_type VARCHAR(10) NOT NULL DEFAULT 'payment';
+
+-- Amount an applied callback says the acquirer moved, in the payment's currency; reports count a
+-- reversal as this when it is known
+ALTER TABLE gateway_callback_events ADD COLUMN amount DECIMAL(14,2);
+
+-- Refunds are recorded as pending before the gateway is asked for the money and finalized once it
+-- has answered; refunds made before this were all completed
+ALTER TABLE payment_refunds ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'Succeeded';
+
+-- The parts of a payment's request its row does not record, so whichever instance is asked to can
+-- finish it, e.g. charge a payment held for fraud review once an admin approves it. A card is only
+-- kept as the token the gateway issued for it.
+ALTER TABLE payment_transactions ADD COLUMN resume_data JSONB;
+
+-- Room for the longest payment status, AuthenticationRequired
+ALTER TABLE payment_transactions ALTER COLUMN payment_status TYPE VARCHAR(32);
+ALTER TABLE reconciliation_items ALTER COLUMN payment_status TYPE VARCHAR(32);
+
+-- Whether the customer asked at checkout for the plan to be renewed every month. Only the latest
+-- successful checkout of a plan counts; renewals themselves leave it as it is.
+ALTER TABLE payment_transactions ADD COLUMN auto_renew BOOLEAN NOT NULL DEFAULT false;
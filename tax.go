@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"sportlife/types"
+)
+
+const taxRatesPath = "tax_rates.json"
+
+// How VAT is rounded to whole tiyn
+const (
+	// Every line is rounded on its own and the receipt adds the rounded lines up
+	taxRoundingLine = "line"
+	// VAT is rounded once per rate over the whole receipt and spread back over the lines
+	taxRoundingReceipt = "receipt"
+)
+
+// VAT rates by plan and catalog item. Prices are VAT-inclusive, as Kazakh retail prices are.
+type taxRules struct {
+	// Percentage applied to anything without its own rate
+	DefaultRate float64 `json:"defaultRate"`
+	// Default rate of payments in another currency, taken at a branch in another country
+	CurrencyRates map[types.Currency]float64 `json:"currencyRates"`
+	Rounding      string                     `json:"rounding"`
+	// Rates by subscription type and by catalog item ID
+	Plans  map[string]float64 `json:"plans"`
+	Items  map[string]float64 `json:"items"`
+	Exempt struct {
+		Plans []string `json:"plans"`
+		Items []string `json:"items"`
+	} `json:"exempt"`
+	// Fiscal details of the seller printed on every receipt
+	Seller struct {
+		Name string `json:"name"`
+		BIN  string `json:"bin"`
+	} `json:"seller"`
+}
+
+var taxConfig taxRules
+
+// Load the VAT rates from tax_rates.json
+func loadTaxRates() error {
+	file, err := os.ReadFile(taxRatesPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(file, &taxConfig); err != nil {
+		return err
+	}
+	if taxConfig.Rounding != taxRoundingLine && taxConfig.Rounding != taxRoundingReceipt {
+		return fmt.Errorf("%s: rounding must be %q or %q", taxRatesPath, taxRoundingLine, taxRoundingReceipt)
+	}
+	rates := []float64{taxConfig.DefaultRate}
+	for _, rate := range taxConfig.CurrencyRates {
+		rates = append(rates, rate)
+	}
+	for _, rate := range taxConfig.Plans {
+		rates = append(rates, rate)
+	}
+	for _, rate := range taxConfig.Items {
+		rates = append(rates, rate)
+	}
+	for _, rate := range rates {
+		if rate < 0 || rate >= 100 {
+			return fmt.Errorf("%s: rates must be percentages between 0 and 100", taxRatesPath)
+		}
+	}
+	return nil
+}
+
+// VAT on one line of a payment
+type TaxLine struct {
+	Name   string      `json:"name"`
+	Rate   float64     `json:"rate"`
+	Exempt bool        `json:"exempt,omitempty"`
+	Net    types.Money `json:"net"`
+	Tax    types.Money `json:"tax"`
+	Gross  types.Money `json:"gross"`
+}
+
+// Receipt total for one VAT rate
+type TaxRateTotal struct {
+	Rate   float64     `json:"rate"`
+	Exempt bool        `json:"exempt,omitempty"`
+	Net    types.Money `json:"net"`
+	Tax    types.Money `json:"tax"`
+	Gross  types.Money `json:"gross"`
+}
+
+// Net, VAT and gross of a payment, per line and per rate
+type TaxBreakdown struct {
+	Lines []TaxLine      `json:"lines"`
+	Rates []TaxRateTotal `json:"rates"`
+	Net   types.Money    `json:"net"`
+	Tax   types.Money    `json:"tax"`
+	Gross types.Money    `json:"gross"`
+}
+
+// Move every amount of a breakdown stored without its currency into the payment's currency
+func (b *TaxBreakdown) setCurrency(currency types.Currency) error {
+	amounts := []*types.Money{&b.Net, &b.Tax, &b.Gross}
+	for i := range b.Lines {
+		amounts = append(amounts, &b.Lines[i].Net, &b.Lines[i].Tax, &b.Lines[i].Gross)
+	}
+	for i := range b.Rates {
+		amounts = append(amounts, &b.Rates[i].Net, &b.Rates[i].Tax, &b.Rates[i].Gross)
+	}
+	return setCurrency(currency, amounts...)
+}
+
+// Look up the VAT rate of a plan or catalog item paid for in a currency
+func (t *taxRules) rate(rates map[string]float64, exempt []string, key string, currency types.Currency) (float64, bool) {
+	if contains(exempt, key) {
+		return 0, true
+	}
+	if rate, ok := rates[key]; ok {
+		return rate, false
+	}
+	if rate, ok := t.CurrencyRates[currency]; ok {
+		return rate, false
+	}
+	return t.DefaultRate, false
+}
+
+// Split a payment into VAT lines: one per cart item, or a single line for a subscription
+func calculateTax(subscriptionType string, amount types.Money, items []LineItem) (TaxBreakdown, error) {
+	var lines []TaxLine
+	if len(items) == 0 {
+		rate, exempt := taxConfig.rate(taxConfig.Plans, taxConfig.Exempt.Plans, subscriptionType, amount.Currency())
+		lines = append(lines, TaxLine{Name: subscriptionType, Rate: rate, Exempt: exempt, Gross: amount})
+	}
+	for _, item := range items {
+		rate, exempt := taxConfig.rate(taxConfig.Items, taxConfig.Exempt.Items, item.ItemID, amount.Currency())
+		lines = append(lines, TaxLine{Name: item.Name, Rate: rate, Exempt: exempt, Gross: item.Total})
+	}
+	return taxBreakdown(lines, taxConfig.Rounding)
+}
+
+type taxRateKey struct {
+	rate   float64
+	exempt bool
+}
+
+// Fill in net and VAT of VAT-inclusive lines and total them per rate. The lines always add up
+// to the rate totals and the rate totals to the receipt total. Lines must all be in one currency.
+func taxBreakdown(lines []TaxLine, rounding string) (TaxBreakdown, error) {
+	if len(lines) == 0 {
+		return TaxBreakdown{}, nil
+	}
+	zero := types.Zero(lines[0].Gross.Currency())
+	// The first currency mismatch sticks and every later sum is skipped
+	var err error
+	add := func(sum *types.Money, m types.Money) {
+		if err == nil {
+			*sum, err = sum.Add(m)
+		}
+	}
+	groups := make(map[taxRateKey][]int)
+	var keys []taxRateKey
+	for i, line := range lines {
+		key := taxRateKey{line.Rate, line.Exempt}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+		lines[i].Tax = zero
+	}
+
+	for _, key := range keys {
+		if key.exempt || key.rate == 0 {
+			continue
+		}
+		if rounding == taxRoundingLine {
+			for _, i := range groups[key] {
+				lines[i].Tax = lines[i].Gross.IncludedPercent(key.rate, types.RoundHalfUp)
+			}
+			continue
+		}
+
+		// Round the rate total once, then spread it over the lines in proportion to their price
+		groupGross := zero
+		ratios := make([]int64, 0, len(groups[key]))
+		for _, i := range groups[key] {
+			add(&groupGross, lines[i].Gross)
+			ratios = append(ratios, lines[i].Gross.Minor())
+		}
+		shares := groupGross.IncludedPercent(key.rate, types.RoundHalfUp).Allocate(ratios...)
+		for n, i := range groups[key] {
+			lines[i].Tax = shares[n]
+		}
+	}
+
+	breakdown := TaxBreakdown{Net: zero, Tax: zero, Gross: zero}
+	for _, key := range keys {
+		total := TaxRateTotal{Rate: key.rate, Exempt: key.exempt, Net: zero, Tax: zero, Gross: zero}
+		for _, i := range groups[key] {
+			lines[i].Net = lines[i].Gross
+			add(&lines[i].Net, lines[i].Tax.Neg())
+			add(&total.Net, lines[i].Net)
+			add(&total.Tax, lines[i].Tax)
+			add(&total.Gross, lines[i].Gross)
+		}
+		breakdown.Rates = append(breakdown.Rates, total)
+		add(&breakdown.Net, total.Net)
+		add(&breakdown.Tax, total.Tax)
+		add(&breakdown.Gross, total.Gross)
+	}
+	if err != nil {
+		return TaxBreakdown{}, err
+	}
+	breakdown.Lines = lines
+	return breakdown, nil
+}
+
+// Label of a VAT rate as printed on receipts
+func taxRateLabel(rate float64, exempt bool) string {
+	if exempt {
+		return "Без НДС"
+	}
+	return fmt.Sprintf("НДС %g%%", rate)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"sportlife/types"
+)
+
+func TestTaxBreakdownRounding(t *testing.T) {
+	tests := []struct {
+		rounding string
+		wantTax  []int64
+	}{
+		// 12% of 10.05 included is 1.0768 per line, 2.1536 for both
+		{taxRoundingLine, []int64{108, 108}},
+		{taxRoundingReceipt, []int64{108, 107}},
+	}
+	for _, tt := range tests {
+		lines := []TaxLine{
+			{Name: "Towel", Rate: 12, Gross: types.NewMoney(1005, types.KZT)},
+			{Name: "Water", Rate: 12, Gross: types.NewMoney(1005, types.KZT)},
+		}
+		b, err := taxBreakdown(lines, tt.rounding)
+		if err != nil {
+			t.Fatalf("%s rounding: %v", tt.rounding, err)
+		}
+		var tax int64
+		for i, line := range b.Lines {
+			tax += tt.wantTax[i]
+			if line.Tax.Minor() != tt.wantTax[i] {
+				t.Errorf("%s rounding: line %d VAT = %d, want %d", tt.rounding, i, line.Tax.Minor(), tt.wantTax[i])
+			}
+			if line.Net.Minor()+line.Tax.Minor() != line.Gross.Minor() {
+				t.Errorf("%s rounding: line %d net %d + VAT %d != gross %d", tt.rounding, i, line.Net.Minor(), line.Tax.Minor(), line.Gross.Minor())
+			}
+		}
+		if len(b.Rates) != 1 || b.Rates[0].Tax.Minor() != tax {
+			t.Errorf("%s rounding: rate totals = %+v, want one with VAT %d", tt.rounding, b.Rates, tax)
+		}
+		if b.Tax.Minor() != tax || b.Gross.Minor() != 2010 || b.Net.Minor() != 2010-tax {
+			t.Errorf("%s rounding: totals net %d VAT %d gross %d", tt.rounding, b.Net.Minor(), b.Tax.Minor(), b.Gross.Minor())
+		}
+	}
+}
+
+func TestTaxBreakdownRates(t *testing.T) {
+	lines := []TaxLine{
+		{Name: "Premium", Rate: 12, Gross: types.NewMoney(11200, types.KZT)},
+		{Name: "Book", Exempt: true, Gross: types.NewMoney(5000, types.KZT)},
+	}
+	b, err := taxBreakdown(lines, taxRoundingLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Rates) != 2 {
+		t.Fatalf("got %d rate totals, want 2", len(b.Rates))
+	}
+	if r := b.Rates[0]; r.Rate != 12 || r.Tax.Minor() != 1200 || r.Net.Minor() != 10000 {
+		t.Errorf("12%% total = %+v, want VAT 1200 on net 10000", r)
+	}
+	if r := b.Rates[1]; !r.Exempt || !r.Tax.IsZero() || r.Net.Minor() != 5000 {
+		t.Errorf("exempt total = %+v, want no VAT on net 5000", r)
+	}
+	if b.Tax.Minor() != 1200 || b.Gross.Minor() != 16200 {
+		t.Errorf("totals VAT %d gross %d, want 1200 and 16200", b.Tax.Minor(), b.Gross.Minor())
+	}
+}
+
+func TestTaxBreakdownCurrencyMismatch(t *testing.T) {
+	lines := []TaxLine{
+		{Name: "Premium", Rate: 12, Gross: types.NewMoney(11200, types.KZT)},
+		{Name: "Towel", Rate: 12, Gross: types.NewMoney(500, types.USD)},
+	}
+	if _, err := taxBreakdown(lines, taxRoundingReceipt); !errors.Is(err, types.ErrCurrencyMismatch) {
+		t.Errorf("error = %v, want ErrCurrencyMismatch", err)
+	}
+}
+
+func TestCalculateTax(t *testing.T) {
+	saved := taxConfig
+	defer func() { taxConfig = saved }()
+	taxConfig = taxRules{
+		DefaultRate:   12,
+		CurrencyRates: map[types.Currency]float64{types.RUB: 20},
+		Rounding:      taxRoundingLine,
+		Plans:         map[string]float64{"Kids": 0},
+		Items:         map[string]float64{"water": 5},
+	}
+	taxConfig.Exempt.Items = []string{"book"}
+
+	tests := []struct {
+		name             string
+		subscriptionType string
+		amount           types.Money
+		items            []LineItem
+		wantRates        []float64
+		wantTax          int64
+	}{
+		{"plan at the default rate", "Premium", types.NewMoney(11200, types.KZT), nil, []float64{12}, 1200},
+		{"plan with its own rate", "Kids", types.NewMoney(10000, types.KZT), nil, []float64{0}, 0},
+		{"plan paid in another currency", "Premium", types.NewMoney(12000, types.RUB), nil, []float64{20}, 2000},
+		{"cart items", cartSubscriptionType, types.NewMoney(21500, types.KZT), []LineItem{
+			{ItemID: "water", Name: "Water", Total: types.NewMoney(10500, types.KZT)},
+			{ItemID: "book", Name: "Book", Total: types.NewMoney(5000, types.KZT)},
+			{ItemID: "towel", Name: "Towel", Total: types.NewMoney(6000, types.KZT)},
+		}, []float64{5, 0, 12}, 500 + 643},
+	}
+	for _, tt := range tests {
+		b, err := calculateTax(tt.subscriptionType, tt.amount, tt.items)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(b.Lines) != len(tt.wantRates) {
+			t.Errorf("%s: got %d lines, want %d", tt.name, len(b.Lines), len(tt.wantRates))
+			continue
+		}
+		for i, line := range b.Lines {
+			if line.Rate != tt.wantRates[i] {
+				t.Errorf("%s: line %d rate = %g, want %g", tt.name, i, line.Rate, tt.wantRates[i])
+			}
+		}
+		if b.Tax.Minor() != tt.wantTax || b.Tax.Currency() != tt.amount.Currency() {
+			t.Errorf("%s: VAT = %s, want %d %s", tt.name, b.Tax, tt.wantTax, tt.amount.Currency())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"sportlife/types"
+)
+
+// How long a cardholder has to complete a 3-D Secure challenge before the payment is declined.
+// THREEDS_CHALLENGE_TIMEOUT overrides it.
+var challengeTimeout = envDuration("THREEDS_CHALLENGE_TIMEOUT", 10*time.Minute)
+
+// A payment parked until its cardholder answers the challenge. The card number stays in
+// memory only, so the callback has to reach the instance that issued the challenge.
+type pendingChallenge struct {
+	Job              paymentJob
+	AuthenticationID string
+	timer            *time.Timer
+}
+
+type challengeRegistry struct {
+	mu      sync.Mutex
+	pending map[string]*pendingChallenge
+}
+
+var challenges = &challengeRegistry{pending: make(map[string]*pendingChallenge)}
+
+func init() {
+	// Payments still waiting for their cardholder cannot be resumed after a restart
+	onShutdown(func(ctx context.Context) error {
+		challenges.mu.Lock()
+		pending := challenges.pending
+		challenges.pending = make(map[string]*pendingChallenge)
+		challenges.mu.Unlock()
+
+		for _, p := range pending {
+			p.timer.Stop()
+			declineParkedPayment(ctx, p.Job, "Authentication was interrupted, please try again")
+		}
+		return nil
+	})
+}
+
+// Park a payment until its challenge is answered or times out
+func (c *challengeRegistry) add(job paymentJob, authenticationID string) {
+	p := &pendingChallenge{Job: job, AuthenticationID: authenticationID}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[job.TransactionID] = p
+	p.timer = time.AfterFunc(challengeTimeout, func() {
+		if c.take(job.TransactionID, p) {
+			declineParkedPayment(context.Background(), job, "Authentication timed out")
+		}
+	})
+}
+
+// Remove p if it is still the payment's pending challenge. Reports whether it was.
+func (c *challengeRegistry) take(transactionID string, p *pendingChallenge) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[transactionID] != p {
+		return false
+	}
+	delete(c.pending, transactionID)
+	return true
+}
+
+func (c *challengeRegistry) get(transactionID string) (*pendingChallenge, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[transactionID]
+	return p, ok
+}
+
+// Decline a payment parked in memory, waiting for its cardholder or its fraud review, that can no
+// longer be charged
+func declineParkedPayment(ctx context.Context, job paymentJob, message string) {
+	logger := logFrom(ctx).With("request_id", job.RequestID, "transaction_id", job.TransactionID)
+	logger.Info("Payment declined", "reason", message)
+	event := paymentEvent(job.TransactionID, paymentStatusDeclined, job.SubscriptionType, job.Data.Amount, message)
+	parked := []string{paymentStatusAuthenticationRequired, paymentStatusOnHold}
+	declined, err := updatePaymentStatus(ctx, job.TransactionID, paymentStatusDeclined, parked, event)
+	if err != nil {
+		logger.Error("Error updating payment status", "status", paymentStatusDeclined, "error", err)
+	} else if !declined {
+		logger.Info("Payment was settled elsewhere while parked")
+		return
+	}
+	if err := settleCartTransaction(ctx, job.TransactionID, paymentStatusDeclined); err != nil {
+		logger.Error("Error settling cart transaction", "status", paymentStatusDeclined, "error", err)
+	}
+	recordPayment("declined", job.SubscriptionType, job.Data.Amount)
+	payments.publish(PaymentStatus{TransactionID: job.TransactionID, Status: paymentStatusDeclined, Stage: stageCompleted, Message: message})
+}
+
+// Where the challenge page posts the cardholder back to for a payment
+func challengeReturnURL(transactionID string) string {
+	return "/v1/payments/" + transactionID + "/3ds/callback"
+}
+
+// Resume a payment once the cardholder has gone through the challenge page
+func handleChallengeCallback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid form")
+		return
+	}
+	transactionID := r.PathValue("id")
+
+	p, ok := challenges.get(transactionID)
+	if !ok || p.AuthenticationID != r.PostForm.Get("authenticationId") {
+		writeError(w, r, types.ErrCodeNotFound, "No authentication is pending for this payment")
+		return
+	}
+	if !challenges.take(transactionID, p) {
+		writeError(w, r, types.ErrCodeConflict, "Authentication has already been completed")
+		return
+	}
+	p.timer.Stop()
+
+	job := p.Job
+	job.AuthenticationID = p.AuthenticationID
+	job.AuthenticationResponse = r.PostForm.Get("cres")
+	if !enqueuePayment(job) {
+		// Park it again so the cardholder can resubmit once the queue drains
+		challenges.add(p.Job, p.AuthenticationID)
+		w.Header().Set("Retry-After", strconv.Itoa(int(queueFullRetryAfter.Seconds())))
+		writeError(w, r, types.ErrCodeOverloaded, "Too many payments in progress, please retry shortly")
+		return
+	}
+	payments.publish(PaymentStatus{TransactionID: transactionID, Status: paymentStatusProcessing, Stage: stageQueued})
+
+	logFrom(r.Context()).Info("Cardholder authentication returned", "transaction_id", transactionID)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`<!DOCTYPE html><html><head><meta charset="UTF-8"></head><body style="font-family: Arial, sans-serif"><p>Проверка завершена, возвращаемся к оплате...</p></body></html>`))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"sportlife/types"
+)
+
+// The code the simulated issuer accepts on its challenge page
+const simulatedChallengeCode = "1234"
+
+var challengePageTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>3-D Secure</title>
+	<style>
+		body { font-family: Arial, sans-serif; margin: 0; padding: 20px; background: #f5f5f5; }
+		.box { max-width: 360px; margin: 0 auto; background: white; padding: 20px; border-radius: 8px; }
+		input { width: 100%; padding: 8px; margin: 10px 0; box-sizing: border-box; }
+		button { padding: 10px 16px; border: none; border-radius: 4px; cursor: pointer; }
+		.confirm { background: #47a447; color: white; }
+		.cancel { background: #ddd; }
+		.error { color: #721c24; }
+	</style>
+</head>
+<body>
+	<div class="box">
+		<h3>Подтверждение платежа</h3>
+		<p>Сумма: {{.Amount}}</p>
+		<p>Введите код из SMS (в тестовом режиме: {{.Code}}).</p>
+		{{if .Failed}}<p class="error">Неверный код.</p>{{end}}
+		<form method="POST">
+			<input type="text" name="code" autocomplete="one-time-code" autofocus>
+			<button type="submit" class="confirm" name="action" value="confirm">Подтвердить</button>
+			<button type="submit" class="cancel" name="action" value="cancel">Отмена</button>
+		</form>
+	</div>
+</body>
+</html>`))
+
+// Auto-submitting form that carries the challenge result back to the merchant, as an issuer's ACS would
+var challengeReturnTemplate = template.Must(template.New("return").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+	<form method="POST" action="{{.ReturnURL}}">
+		<input type="hidden" name="authenticationId" value="{{.AuthenticationID}}">
+		<input type="hidden" name="cres" value="{{.Response}}">
+		<noscript><button type="submit">Продолжить</button></noscript>
+	</form>
+</body>
+</html>`))
+
+// Serves the challenge pages of simulatedGateway, standing in for the card issuer in development
+type threeDSSimulator struct {
+	gateway *simulatedGateway
+}
+
+func (s threeDSSimulator) handleChallengePage(w http.ResponseWriter, r *http.Request) {
+	ch, ok := s.gateway.challenge(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, types.ErrCodeNotFound, "Challenge not found or expired")
+		return
+	}
+	s.renderChallenge(w, ch, false)
+}
+
+func (s threeDSSimulator) handleChallengeAnswer(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid form")
+		return
+	}
+	id := r.PathValue("id")
+	cancelled := r.PostForm.Get("action") == "cancel"
+	authenticated := !cancelled && r.PostForm.Get("code") == simulatedChallengeCode
+
+	// A wrong code gets another try, only cancelling gives up
+	if !authenticated && !cancelled {
+		ch, ok := s.gateway.challenge(id)
+		if !ok {
+			writeError(w, r, types.ErrCodeNotFound, "Challenge not found or expired")
+			return
+		}
+		s.renderChallenge(w, ch, true)
+		return
+	}
+
+	ch, ok := s.gateway.answerChallenge(id, authenticated)
+	if !ok {
+		writeError(w, r, types.ErrCodeNotFound, "Challenge not found or expired")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	challengeReturnTemplate.Execute(w, map[string]string{
+		"ReturnURL":        ch.ReturnURL,
+		"AuthenticationID": id,
+		"Response":         ch.Response,
+	})
+}
+
+func (s threeDSSimulator) renderChallenge(w http.ResponseWriter, ch simulatedChallenge, failed bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	challengePageTemplate.Execute(w, map[string]interface{}{
+		"Amount": ch.Amount.Format("ru"),
+		"Code":   simulatedChallengeCode,
+		"Failed": failed,
+	})
+}
@@ -1,48 +1,65 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"sportlife/client"
 	"sportlife/types" // Import the shared types
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	paymentWaitTimeout  = 30 * time.Second
+	paymentPollInterval = 500 * time.Millisecond
+)
+
 type TransactionController struct {
-	db *sql.DB
+	db       *sql.DB
+	payments *client.Client
 }
 
-func NewTransactionController(db *sql.DB) *TransactionController {
-	return &TransactionController{db: db}
+func NewTransactionController(db *sql.DB, payments *client.Client) *TransactionController {
+	return &TransactionController{db: db, payments: payments}
 }
 
 func (tc *TransactionController) getCartDetails(c *gin.Context, cart *types.Cart) error {
-	cartID := c.Param("cart_id")
-	// Query the database to get cart details
-	row := tc.db.QueryRow("SELECT id, user_id, total FROM carts WHERE id = $1", cartID)
-	err := row.Scan(&cart.ID, &cart.UserID, &cart.Total)
+	loaded, err := loadCart(c.Request.Context(), tc.db, c.Param("cart_id"))
 	if err != nil {
 		return err
 	}
+	*cart = *loaded
+	return nil
+}
 
-	// Get cart items
-	rows, err := tc.db.Query("SELECT id, name, price, quantity FROM cart_items WHERE cart_id = $1", cartID)
+// Load a cart with its items, or sql.ErrNoRows if there is no such cart. The payment service
+// prices /checkout from the same rows.
+func loadCart(ctx context.Context, conn *sql.DB, cartID string) (*types.Cart, error) {
+	var cart types.Cart
+	row := conn.QueryRowContext(ctx, "SELECT id, user_id, total FROM carts WHERE id = $1", cartID)
+	if err := row.Scan(&cart.ID, &cart.UserID, &cart.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT id, name, price, quantity FROM cart_items WHERE cart_id = $1 ORDER BY id", cartID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var item types.CartItem
 		if err := rows.Scan(&item.ID, &item.Name, &item.Price, &item.Quantity); err != nil {
-			return err
+			return nil, err
 		}
 		cart.Items = append(cart.Items, item)
 	}
-	return nil
+	return &cart, rows.Err()
 }
 
 func (tc *TransactionController) createTransaction(cart types.Cart) (int64, error) {
@@ -54,6 +71,13 @@ func (tc *TransactionController) createTransaction(cart types.Cart) (int64, erro
 	return transactionID, err
 }
 
+// Remember which payment pays for a transaction so the payment service can settle it should the
+// payment finish after this request, as it does when the cardholder has to authenticate
+func (tc *TransactionController) linkPayment(transactionID int64, paymentID string) error {
+	_, err := tc.db.Exec("INSERT INTO cart_payments (cart_transaction_id, payment_transaction_id) VALUES ($1, $2)", transactionID, paymentID)
+	return err
+}
+
 func (tc *TransactionController) updateTransactionStatus(transactionID int64, status string) error {
 	_, err := tc.db.Exec(
 		"UPDATE transactions SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
@@ -62,63 +86,135 @@ func (tc *TransactionController) updateTransactionStatus(transactionID int64, st
 	return err
 }
 
-func preparePaymentRequest(cart types.Cart, userID string) []byte {
-	paymentReq := struct {
-		CartItems []types.CartItem `json:"cartItems"`
-		Customer  struct {
-			ID    string  `json:"id"`
-			Name  string  `json:"name"`
-			Email string  `json:"email"`
-		} `json:"customer"`
-	}{
-		CartItems: cart.Items,
+// Contact and card details posted by the customer when checking out a cart
+type checkoutRequest struct {
+	Email string `json:"email" binding:"required"`
+	Phone string `json:"phone" binding:"required"`
+	types.PaymentForm
+}
+
+// Build the payment service request for a cart checkout. The payment service prices the cart's
+// items itself, stores them as the payment's line items and picks the payment's ID; cart_payments
+// links it to the transaction.
+func paymentDataFromCart(cart types.Cart, req checkoutRequest) client.CheckoutRequest {
+	return client.CheckoutRequest{
+		CartID:     cart.ID,
+		Email:      req.Email,
+		Name:       req.Name,
+		Phone:      req.Phone,
+		CardNumber: req.CardNumber,
+		CartItems:  cart.Items,
+	}
+}
+
+// Wait for the payment service to finish the payment and settle the cart transaction accordingly
+func (tc *TransactionController) awaitPayment(c *gin.Context, transactionID int64, accepted *client.ProcessPaymentResponse) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), paymentWaitTimeout)
+	defer cancel()
+	ctx = client.WithRequestID(ctx, requestID(c.Request))
+
+	status, err := tc.payments.WaitForPayment(ctx, accepted.TransactionID, accepted.StatusToken, paymentPollInterval)
+	if err != nil {
+		// Leave the transaction pending: the payment may still complete
+		abortWithError(c, types.ErrCodeUpstreamUnavailable, "Payment outcome is not known yet")
+		return
+	}
+
+	switch status.Status {
+	case client.StatusAuthenticationRequired:
+		// The transaction stays pending until the cardholder completes the challenge
+		c.JSON(http.StatusAccepted, gin.H{
+			"success":       true,
+			"message":       "Cardholder authentication required",
+			"transactionId": accepted.TransactionID,
+			"challengeUrl":  status.ChallengeURL,
+			"statusUrl":     accepted.StatusURL,
+		})
+	case client.StatusOnHold:
+		// The transaction stays pending until the payment's fraud review is decided
+		c.JSON(http.StatusAccepted, gin.H{
+			"success":       true,
+			"message":       "Payment is being reviewed before it is charged",
+			"transactionId": accepted.TransactionID,
+			"statusUrl":     accepted.StatusURL,
+		})
+	case client.StatusSuccess:
+		tc.updateTransactionStatus(transactionID, "PAID")
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Transaction completed successfully"})
+	case client.StatusDeclined:
+		tc.updateTransactionStatus(transactionID, "DECLINED")
+		abortWithError(c, types.ErrCodePaymentDeclined, status.Message)
+	default:
+		tc.updateTransactionStatus(transactionID, "FAILED")
+		abortWithError(c, types.ErrCodeUpstreamUnavailable, "Payment could not be processed")
 	}
-	
-	// In a real application, you would fetch customer details from the database
-	paymentReq.Customer.ID = userID
-	
-	reqBytes, _ := json.Marshal(paymentReq)
-	return reqBytes
+}
+
+// Abort the gin request with the shared error envelope
+func abortWithError(c *gin.Context, code types.ErrorCode, message string, fields ...types.FieldError) {
+	c.Header(requestIDHeader, requestID(c.Request))
+	c.AbortWithStatusJSON(code.HTTPStatus(), newErrorResponse(c.Request, code, message, fields...))
 }
 
 func (tc *TransactionController) ProcessTransaction(c *gin.Context) {
+	var req checkoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+
 	var cart types.Cart
 	if err := tc.getCartDetails(c, &cart); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err == sql.ErrNoRows {
+			abortWithError(c, types.ErrCodeNotFound, "Cart not found")
+			return
+		}
+		abortWithError(c, types.ErrCodeStorageFailed, "Failed to load cart")
+		return
+	}
+	// Someone else's cart is answered like a missing one
+	if strconv.FormatInt(cart.UserID, 10) != c.GetString("userID") {
+		abortWithError(c, types.ErrCodeNotFound, "Cart not found")
 		return
 	}
 
 	// Create transaction record
 	transactionID, err := tc.createTransaction(cart)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		abortWithError(c, types.ErrCodeStorageFailed, "Failed to create transaction")
 		return
 	}
 
-	// Prepare payment request for microservice
-	paymentReq := preparePaymentRequest(cart, c.GetString("userID"))
-	
 	// Send to payment microservice
-	resp, err := http.Post(
-		"http://localhost:8081/process-payment",
-		"application/json",
-		bytes.NewBuffer(paymentReq),
-	)
-	
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment service unavailable"})
+	ctx := client.WithRequestID(c.Request.Context(), requestID(c.Request))
+	ctx = client.WithForwardedFor(ctx, c.ClientIP())
+	accepted, err := tc.payments.Checkout(ctx, paymentDataFromCart(cart, req))
+	if err == nil {
+		if err := tc.linkPayment(transactionID, accepted.TransactionID); err != nil {
+			logFrom(ctx).Error("Error linking cart transaction to its payment", "cart_transaction_id", transactionID, "transaction_id", accepted.TransactionID, "error", err)
+		}
+		tc.awaitPayment(c, transactionID, accepted)
 		return
 	}
 
-	// Handle response
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
-	
-	if result["status"] == "success" {
-		tc.updateTransactionStatus(transactionID, "PAID")
-		c.JSON(http.StatusOK, gin.H{"message": "Transaction completed successfully"})
-	} else {
+	// Only a decline declines the cart; server-side failures are not the customer's doing
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode >= 500 {
+		tc.updateTransactionStatus(transactionID, "FAILED")
+		abortWithError(c, types.ErrCodeUpstreamUnavailable, "Payment service unavailable")
+		return
+	}
+	if apiErr.Code == types.ErrCodePaymentDeclined {
 		tc.updateTransactionStatus(transactionID, "DECLINED")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment declined"})
+		abortWithError(c, types.ErrCodePaymentDeclined, apiErr.Message)
+		return
 	}
-} 
\ No newline at end of file
+
+	// The payment was never started: hand back the payment service's answer as it came, so
+	// the customer can fix the request or retry once the rate limit has passed
+	tc.updateTransactionStatus(transactionID, "FAILED")
+	if apiErr.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+	}
+	abortWithError(c, apiErr.Code, apiErr.Message, apiErr.Fields...)
+}
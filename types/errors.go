@@ -0,0 +1,73 @@
+package types
+
+import "net/http"
+
+// ErrorCode is a stable, machine-readable identifier for an API failure.
+// Clients should branch on the code, never on the message text.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidRequest      ErrorCode = "invalid_request"
+	ErrCodeValidationFailed    ErrorCode = "validation_failed"
+	ErrCodeUnauthorized        ErrorCode = "unauthorized"
+	ErrCodeForbidden           ErrorCode = "forbidden"
+	ErrCodeNotFound            ErrorCode = "not_found"
+	ErrCodeConflict            ErrorCode = "conflict"
+	ErrCodeRateLimited         ErrorCode = "rate_limited"
+	ErrCodePaymentDeclined     ErrorCode = "payment_declined"
+	ErrCodeReceiptFailed       ErrorCode = "receipt_failed"
+	ErrCodeEmailFailed         ErrorCode = "email_failed"
+	ErrCodeStorageFailed       ErrorCode = "storage_failed"
+	ErrCodeUpstreamUnavailable ErrorCode = "upstream_unavailable"
+	ErrCodeOverloaded          ErrorCode = "overloaded"
+	ErrCodeInternal            ErrorCode = "internal_error"
+)
+
+// HTTPStatus returns the HTTP status code used when replying with this error code
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case ErrCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrCodeValidationFailed:
+		return http.StatusUnprocessableEntity
+	case ErrCodeUnauthorized:
+		return http.StatusUnauthorized
+	case ErrCodeForbidden:
+		return http.StatusForbidden
+	case ErrCodeNotFound:
+		return http.StatusNotFound
+	case ErrCodeConflict:
+		return http.StatusConflict
+	case ErrCodeRateLimited:
+		return http.StatusTooManyRequests
+	case ErrCodePaymentDeclined:
+		return http.StatusPaymentRequired
+	case ErrCodeUpstreamUnavailable:
+		return http.StatusBadGateway
+	case ErrCodeOverloaded:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type APIError struct {
+	Code      ErrorCode    `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// ErrorResponse is the envelope every failed request is answered with
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
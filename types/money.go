@@ -0,0 +1,447 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Currency is an ISO 4217 currency code
+type Currency string
+
+const (
+	KZT Currency = "KZT"
+	RUB Currency = "RUB"
+	UZS Currency = "UZS"
+	USD Currency = "USD"
+)
+
+// DefaultCurrency is assumed for amounts that do not name a currency
+const DefaultCurrency = KZT
+
+// ErrCurrencyMismatch is returned when amounts in different currencies are combined or compared
+var ErrCurrencyMismatch = errors.New("money: currencies differ")
+
+type currencyInfo struct {
+	// Number of minor units digits, e.g. 2 for tenge and tiyn
+	digits int
+	// How the amount is labelled in Russian and English text
+	ruName, enSymbol string
+}
+
+var currencies = map[Currency]currencyInfo{
+	KZT: {digits: 2, ruName: "тенге", enSymbol: "KZT"},
+	RUB: {digits: 2, ruName: "руб.", enSymbol: "RUB"},
+	UZS: {digits: 2, ruName: "сум", enSymbol: "UZS"},
+	USD: {digits: 2, ruName: "долл. США", enSymbol: "$"},
+}
+
+// Valid reports whether the currency is one the service knows how to handle
+func (c Currency) Valid() bool {
+	_, ok := currencies[c]
+	return ok
+}
+
+// Digits returns the number of minor unit digits of the currency
+func (c Currency) Digits() int {
+	return currencies[c.orDefault()].digits
+}
+
+func (c Currency) orDefault() Currency {
+	if c == "" {
+		return DefaultCurrency
+	}
+	return c
+}
+
+// RoundingMode decides what happens to a fraction of a minor unit
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halves away from zero, the usual commercial rounding
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halves to the nearest even minor unit (banker's rounding)
+	RoundHalfEven
+	// RoundDown drops the fraction (towards zero)
+	RoundDown
+	// RoundUp rounds any fraction away from zero
+	RoundUp
+)
+
+// Money is an exact amount held as an integer number of minor units of a currency.
+// The zero value is zero in DefaultCurrency.
+type Money struct {
+	minor    int64
+	currency Currency
+}
+
+// NewMoney returns an amount given in minor units, e.g. NewMoney(150, KZT) is 1.50 tenge
+func NewMoney(minor int64, currency Currency) Money {
+	return Money{minor: minor, currency: currency.orDefault()}
+}
+
+// Zero returns no money in the currency
+func Zero(currency Currency) Money {
+	return NewMoney(0, currency)
+}
+
+// ParseMoney parses a decimal amount in major units such as "25000.50". It fails rather than
+// round when the amount has more decimal places than the currency allows.
+func ParseMoney(s string, currency Currency) (Money, error) {
+	currency = currency.orDefault()
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return Money{}, fmt.Errorf("money: %q is not a decimal amount", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt(pow10(currency.Digits())))
+	if !r.IsInt() {
+		return Money{}, fmt.Errorf("money: %q has more than %d decimal places", s, currency.Digits())
+	}
+	if !r.Num().IsInt64() {
+		return Money{}, fmt.Errorf("money: %q is out of range", s)
+	}
+	return NewMoney(r.Num().Int64(), currency), nil
+}
+
+// FromFloat converts a float amount in major units, rounding half-even to the nearest minor unit.
+// Only meant for values that are not money to begin with, such as figures in config files.
+func FromFloat(amount float64, currency Currency) Money {
+	currency = currency.orDefault()
+	return NewMoney(scaleFloat(amount, currency.Digits()), currency)
+}
+
+// WithCurrency reads the same major-unit amount as one in another currency, for amounts that were
+// decoded before their currency was known. It fails when the amount has more decimal places than
+// the new currency allows.
+func (m Money) WithCurrency(currency Currency) (Money, error) {
+	return ParseMoney(m.Decimal(), currency)
+}
+
+// Exchange converts m into another currency at rate units of that currency per unit of m's
+func (m Money) Exchange(to Currency, rate *big.Rat, mode RoundingMode) Money {
+	to = to.orDefault()
+	r := new(big.Rat).SetFrac(big.NewInt(m.minor), pow10(m.Currency().Digits()))
+	r.Mul(r, rate)
+	r.Mul(r, new(big.Rat).SetInt(pow10(to.Digits())))
+	return NewMoney(divRound(r.Num(), r.Denom(), mode), to)
+}
+
+// Minor returns the amount in minor units
+func (m Money) Minor() int64 { return m.minor }
+
+// Currency returns the currency of the amount
+func (m Money) Currency() Currency { return m.currency.orDefault() }
+
+// Float64 returns the amount in major units. Use it for metrics and thresholds, never for arithmetic.
+func (m Money) Float64() float64 {
+	f, _ := strconv.ParseFloat(m.Decimal(), 64)
+	return f
+}
+
+func (m Money) IsZero() bool     { return m.minor == 0 }
+func (m Money) IsPositive() bool { return m.minor > 0 }
+func (m Money) IsNegative() bool { return m.minor < 0 }
+
+// Cmp compares two amounts in the same currency, returning -1, 0 or +1. Amounts in different
+// currencies cannot be compared and return ErrCurrencyMismatch.
+func (m Money) Cmp(o Money) (int, error) {
+	if err := m.match(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.minor < o.minor:
+		return -1, nil
+	case m.minor > o.minor:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Equal reports whether two amounts are the same sum of the same currency
+func (m Money) Equal(o Money) bool {
+	return m.Currency() == o.Currency() && m.minor == o.minor
+}
+
+// Add returns m + o. Amounts in different currencies cannot be combined and return ErrCurrencyMismatch.
+func (m Money) Add(o Money) (Money, error) {
+	if err := m.match(o); err != nil {
+		return Money{}, err
+	}
+	return NewMoney(m.minor+o.minor, m.currency), nil
+}
+
+// Sub returns m - o, or ErrCurrencyMismatch like Add
+func (m Money) Sub(o Money) (Money, error) {
+	if err := m.match(o); err != nil {
+		return Money{}, err
+	}
+	return NewMoney(m.minor-o.minor, m.currency), nil
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return NewMoney(-m.minor, m.currency)
+}
+
+// Mul returns m times a whole quantity
+func (m Money) Mul(quantity int64) Money {
+	return NewMoney(m.minor*quantity, m.currency)
+}
+
+// MulRat returns m * num / den rounded to a minor unit with the given mode
+func (m Money) MulRat(num, den int64, mode RoundingMode) Money {
+	product := new(big.Int).Mul(big.NewInt(m.minor), big.NewInt(num))
+	return NewMoney(divRound(product, big.NewInt(den), mode), m.currency)
+}
+
+// Percent returns percent % of m, e.g. m.Percent(12, RoundHalfUp). The percentage is taken to
+// two decimal places.
+func (m Money) Percent(percent float64, mode RoundingMode) Money {
+	return m.MulRat(basisPoints(percent), 10000, mode)
+}
+
+// IncludedPercent returns the part of m that was added on top at percent %, e.g. the VAT
+// contained in a VAT-inclusive price: 112.00 at 12% includes 12.00
+func (m Money) IncludedPercent(percent float64, mode RoundingMode) Money {
+	bp := basisPoints(percent)
+	return m.MulRat(bp, 10000+bp, mode)
+}
+
+// Round rounds m to a multiple of step minor units, e.g. Round(100, RoundHalfUp) for whole tenge
+func (m Money) Round(step int64, mode RoundingMode) Money {
+	return NewMoney(divRound(big.NewInt(m.minor), big.NewInt(step), mode)*step, m.currency)
+}
+
+// Allocate splits m into parts proportional to ratios without losing or creating a minor unit:
+// every part gets its rounded-down share and the units left over go to the parts with the
+// largest remainders, earlier parts first on ties.
+func (m Money) Allocate(ratios ...int64) []Money {
+	parts := make([]Money, len(ratios))
+	var total int64
+	for _, r := range ratios {
+		total += r
+	}
+	if total == 0 {
+		for i := range parts {
+			parts[i] = Zero(m.currency)
+		}
+		if len(parts) > 0 {
+			parts[0] = m
+		}
+		return parts
+	}
+
+	sign := int64(1)
+	amount := m.minor
+	if amount < 0 {
+		sign, amount = -1, -amount
+	}
+	remainders := make([]*big.Int, len(ratios))
+	left := amount
+	for i, r := range ratios {
+		share, rem := new(big.Int).QuoRem(new(big.Int).Mul(big.NewInt(amount), big.NewInt(r)), big.NewInt(total), new(big.Int))
+		parts[i] = NewMoney(share.Int64(), m.currency)
+		remainders[i] = rem
+		left -= share.Int64()
+	}
+	for ; left > 0; left-- {
+		best := 0
+		for i := range remainders {
+			if remainders[i].Cmp(remainders[best]) > 0 {
+				best = i
+			}
+		}
+		parts[best].minor++
+		remainders[best] = big.NewInt(-1)
+	}
+	for i := range parts {
+		parts[i].minor *= sign
+	}
+	return parts
+}
+
+// Split divides m into n parts that differ by at most one minor unit
+func (m Money) Split(n int) []Money {
+	ratios := make([]int64, n)
+	for i := range ratios {
+		ratios[i] = 1
+	}
+	return m.Allocate(ratios...)
+}
+
+// Decimal returns the amount in major units with the currency's decimal places, e.g. "25000.50"
+func (m Money) Decimal() string {
+	digits := m.Currency().Digits()
+	minor := m.minor
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	s := strconv.FormatInt(minor, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// String formats the amount for logs, e.g. "25000.50 KZT"
+func (m Money) String() string {
+	return m.Decimal() + " " + string(m.Currency())
+}
+
+// Format formats the amount for people reading the given locale: "ru" (the default, also
+// "ru-KZ" and the like) gives "25 000,50 тенге", "en" gives "KZT 25,000.50".
+func (m Money) Format(locale string) string {
+	info := currencies[m.Currency()]
+	number := m.FormatNumber(locale)
+	if isEnglish(locale) {
+		if strings.HasPrefix(number, "-") {
+			return "-" + info.enSymbol + " " + number[1:]
+		}
+		return info.enSymbol + " " + number
+	}
+	return number + " " + info.ruName
+}
+
+// FormatNumber formats the amount like Format but without the currency, for table columns
+func (m Money) FormatNumber(locale string) string {
+	intPart, frac, _ := strings.Cut(m.Decimal(), ".")
+	sign := ""
+	if strings.HasPrefix(intPart, "-") {
+		sign, intPart = "-", intPart[1:]
+	}
+	groupSep, decimalSep := " ", ","
+	if isEnglish(locale) {
+		groupSep, decimalSep = ",", "."
+	}
+	s := sign + group(intPart, groupSep)
+	if frac != "" {
+		s += decimalSep + frac
+	}
+	return s
+}
+
+func isEnglish(locale string) bool {
+	return strings.HasPrefix(strings.ToLower(locale), "en")
+}
+
+// Insert a separator between groups of three digits
+func group(digits, sep string) string {
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// MarshalJSON writes the amount as a JSON number in major units so the API keeps its shape;
+// the currency travels in its own field where it matters.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.Decimal()), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one, in major units. The currency
+// already set on m is kept, DefaultCurrency otherwise.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("money: %s is not an amount", b)
+		}
+		s = n.String()
+	}
+	parsed, err := ParseMoney(s, m.currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount in a DECIMAL column
+func (m Money) Value() (driver.Value, error) {
+	return m.Decimal(), nil
+}
+
+// Scan reads a DECIMAL column. The currency already set on m is kept, DefaultCurrency otherwise.
+func (m *Money) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		*m = FromFloat(v, m.currency)
+		return nil
+	default:
+		return fmt.Errorf("money: cannot scan %T", src)
+	}
+	parsed, err := ParseMoney(s, m.currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) match(o Money) error {
+	if m.Currency() != o.Currency() {
+		return fmt.Errorf("%w: cannot combine %s and %s amounts", ErrCurrencyMismatch, m.Currency(), o.Currency())
+	}
+	return nil
+}
+
+// Hundredths of a percent, so 12.5% is 1250
+func basisPoints(percent float64) int64 {
+	return scaleFloat(percent, 2)
+}
+
+// Multiply v by 10^digits and round half-even to an integer, going through the shortest decimal
+// form of v so 0.1 is treated as exactly one tenth
+func scaleFloat(v float64, digits int) int64 {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+	r.Mul(r, new(big.Rat).SetInt(pow10(digits)))
+	return divRound(r.Num(), r.Denom(), RoundHalfEven)
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// Divide a by b (b > 0) rounding to an integer with the given mode
+func divRound(a, b *big.Int, mode RoundingMode) int64 {
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	if r.Sign() == 0 {
+		return q.Int64()
+	}
+	away := int64(a.Sign())
+	switch mode {
+	case RoundDown:
+		return q.Int64()
+	case RoundUp:
+		return q.Int64() + away
+	}
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	switch c := twice.Cmp(b); {
+	case c > 0:
+		return q.Int64() + away
+	case c == 0 && (mode == RoundHalfUp || q.Bit(0) == 1):
+		return q.Int64() + away
+	}
+	return q.Int64()
+}
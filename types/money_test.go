@@ -0,0 +1,168 @@
+package types
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in        string
+		currency  Currency
+		wantMinor int64
+		wantErr   bool
+	}{
+		{"25000.50", KZT, 2500050, false},
+		{"25000.5", KZT, 2500050, false},
+		{"25000", KZT, 2500000, false},
+		{" 1.05 ", USD, 105, false},
+		{"-3.10", RUB, -310, false},
+		{"0", "", 0, false},
+		{"0.001", KZT, 0, true},
+		{"12,50", KZT, 0, true},
+		{"abc", KZT, 0, true},
+		{"", KZT, 0, true},
+		{"100000000000000000000", KZT, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Minor() != tt.wantMinor || got.Currency() != tt.currency.orDefault() {
+			t.Errorf("ParseMoney(%q, %q) = %d %s, want %d %s", tt.in, tt.currency, got.Minor(), got.Currency(), tt.wantMinor, tt.currency.orDefault())
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{NewMoney(2500050, KZT), "25000.50"},
+		{NewMoney(5, KZT), "0.05"},
+		{NewMoney(-5, KZT), "-0.05"},
+		{NewMoney(0, USD), "0.00"},
+		{Money{}, "0.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%d.Decimal() = %q, want %q", tt.m.Minor(), got, tt.want)
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Money
+		want int64
+	}{
+		{"half up rounds halves away from zero", NewMoney(5, KZT).MulRat(1, 2, RoundHalfUp), 3},
+		{"half up on a negative amount", NewMoney(-5, KZT).MulRat(1, 2, RoundHalfUp), -3},
+		{"half even rounds down to even", NewMoney(5, KZT).MulRat(1, 2, RoundHalfEven), 2},
+		{"half even rounds up to even", NewMoney(7, KZT).MulRat(1, 2, RoundHalfEven), 4},
+		{"down drops the fraction", NewMoney(19, KZT).MulRat(1, 10, RoundDown), 1},
+		{"up rounds any fraction away", NewMoney(11, KZT).MulRat(1, 10, RoundUp), 2},
+		{"percent", NewMoney(100000, KZT).Percent(12.5, RoundHalfUp), 12500},
+		{"included VAT", NewMoney(11200, KZT).IncludedPercent(12, RoundHalfUp), 1200},
+		{"included VAT rounded", NewMoney(1000, KZT).IncludedPercent(12, RoundHalfUp), 107},
+		{"round to whole tenge", NewMoney(2500050, KZT).Round(100, RoundHalfUp), 2500100},
+		{"round to whole tenge down", NewMoney(2500049, KZT).Round(100, RoundHalfUp), 2500000},
+		{"from float", FromFloat(0.1+0.2, KZT), 30},
+		{"exchange", NewMoney(10000, USD).Exchange(KZT, big.NewRat(4505, 10), RoundHalfUp), 4505000},
+	}
+	for _, tt := range tests {
+		if tt.got.Minor() != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.got.Minor(), tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		m      Money
+		ratios []int64
+		want   []int64
+	}{
+		{NewMoney(100, KZT), []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{NewMoney(-100, KZT), []int64{1, 1, 1}, []int64{-34, -33, -33}},
+		{NewMoney(1000, KZT), []int64{3000, 7000}, []int64{300, 700}},
+		{NewMoney(5, KZT), []int64{0, 0}, []int64{5, 0}},
+	}
+	for _, tt := range tests {
+		parts := tt.m.Allocate(tt.ratios...)
+		var sum int64
+		for i, p := range parts {
+			sum += p.Minor()
+			if p.Minor() != tt.want[i] {
+				t.Errorf("%d.Allocate(%v)[%d] = %d, want %d", tt.m.Minor(), tt.ratios, i, p.Minor(), tt.want[i])
+			}
+		}
+		if sum != tt.m.Minor() {
+			t.Errorf("%d.Allocate(%v) adds up to %d", tt.m.Minor(), tt.ratios, sum)
+		}
+	}
+}
+
+func TestArithmeticAcrossCurrencies(t *testing.T) {
+	kzt := NewMoney(1000, KZT)
+	usd := NewMoney(1000, USD)
+
+	if _, err := kzt.Add(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add across currencies: error = %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := kzt.Sub(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Sub across currencies: error = %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := kzt.Cmp(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Cmp across currencies: error = %v, want ErrCurrencyMismatch", err)
+	}
+	if kzt.Equal(usd) {
+		t.Error("Equal reports amounts in different currencies as equal")
+	}
+
+	// The zero value is in DefaultCurrency
+	sum, err := Money{}.Add(kzt)
+	if err != nil || sum.Minor() != 1000 {
+		t.Errorf("zero value + 10 KZT = %v, %v", sum, err)
+	}
+	diff, err := kzt.Sub(NewMoney(250, KZT))
+	if err != nil || diff.Minor() != 750 {
+		t.Errorf("10 KZT - 2.50 KZT = %v, %v", diff, err)
+	}
+	if cmp, err := kzt.Cmp(NewMoney(999, KZT)); err != nil || cmp != 1 {
+		t.Errorf("Cmp = %d, %v, want 1", cmp, err)
+	}
+}
+
+func TestWithCurrency(t *testing.T) {
+	m, err := NewMoney(2550, KZT).WithCurrency(USD)
+	if err != nil || m.Minor() != 2550 || m.Currency() != USD {
+		t.Errorf("WithCurrency(USD) = %v, %v", m, err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		m      Money
+		locale string
+		want   string
+	}{
+		{NewMoney(2500050, KZT), "ru", "25 000,50 тенге"},
+		{NewMoney(2500050, KZT), "en", "KZT 25,000.50"},
+		{NewMoney(-150, USD), "en", "-$ 1.50"},
+		{NewMoney(100000000, RUB), "ru-KZ", "1 000 000,00 руб."},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Format(tt.locale); got != tt.want {
+			t.Errorf("%s.Format(%q) = %q, want %q", tt.m, tt.locale, got, tt.want)
+		}
+	}
+}
@@ -4,20 +4,23 @@ type Cart struct {
 	ID     int64      `json:"id"`
 	UserID int64      `json:"user_id"`
 	Items  []CartItem `json:"items"`
-	Total  float64    `json:"total"`
+	Total  Money      `json:"total"`
 }
 
 type CartItem struct {
-	ID       string  `json:"id"`
-	Name     string  `json:"name"`
-	Price    float64 `json:"price"`
-	Quantity int     `json:"quantity"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Price    Money  `json:"price"`
+	Quantity int    `json:"quantity"`
 }
 
 type Customer struct {
-	ID    string `json:"id"`
+	ID    int64  `json:"id"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
+	Phone string `json:"phone,omitempty"`
+	// Language the customer is written to in, "ru" or "en"
+	Locale string `json:"locale"`
 }
 
 type PaymentRequest struct {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"sportlife/types"
+)
+
+var (
+	// Kazakh and Russian (+7) or Uzbek (+998) numbers
+	phonePattern      = regexp.MustCompile(`^\+(7\d{10}|998\d{9})$`)
+	cardNumberPattern = regexp.MustCompile(`^\d{16}$`)
+)
+
+// Validate the init payment request and return one error per bad field
+func validateInitPaymentRequest(req InitPaymentRequest) []types.FieldError {
+	var fields []types.FieldError
+	if req.SubscriptionType == "" {
+		fields = append(fields, types.FieldError{Field: "subscriptionType", Message: "is required"})
+	}
+	if req.Currency != "" && !isPaymentCurrency(req.Currency) {
+		fields = append(fields, types.FieldError{Field: "currency", Message: "must be one of " + paymentCurrencyList()})
+	}
+	return fields
+}
+
+// Validate the customer's payment data and return one error per bad field
+func validatePaymentData(data PaymentData) []types.FieldError {
+	var fields []types.FieldError
+	// A bare address only: ParseAddress also takes "Name <address>", and the email keys customers,
+	// rate limits and receipts as given
+	if addr, err := mail.ParseAddress(data.Email); err != nil || addr.Address != data.Email {
+		fields = append(fields, types.FieldError{Field: "email", Message: "must be a valid email address"})
+	}
+	if data.Name == "" {
+		fields = append(fields, types.FieldError{Field: "name", Message: "is required"})
+	}
+	if !phonePattern.MatchString(data.Phone) {
+		fields = append(fields, types.FieldError{Field: "phone", Message: "must be in the format +7XXXXXXXXXX or +998XXXXXXXXX"})
+	}
+	if data.PaymentMethodID == 0 && !cardNumberPattern.MatchString(data.CardNumber) {
+		fields = append(fields, types.FieldError{Field: "cardNumber", Message: "must be 16 digits"})
+	}
+	if data.SaveCard && data.PaymentMethodID == 0 {
+		if month, year, err := parseCardExpiry(data.CardExpiry); err != nil {
+			fields = append(fields, types.FieldError{Field: "cardExpiry", Message: err.Error()})
+		} else if cardExpired(month, year, time.Now()) {
+			fields = append(fields, types.FieldError{Field: "cardExpiry", Message: "card has expired"})
+		}
+	}
+	if data.AutoRenew && !data.SaveCard && data.PaymentMethodID == 0 {
+		fields = append(fields, types.FieldError{Field: "autoRenew", Message: "needs a saved card, send saveCard or paymentMethodId"})
+	}
+	if data.Currency != "" && !isPaymentCurrency(data.Currency) {
+		fields = append(fields, types.FieldError{Field: "currency", Message: "must be one of " + paymentCurrencyList()})
+	}
+	if data.Locale != "" && !contains(customerLocales, data.Locale) {
+		fields = append(fields, types.FieldError{Field: "locale", Message: "must be one of " + strings.Join(customerLocales, ", ")})
+	}
+	if !data.Amount.IsPositive() {
+		fields = append(fields, types.FieldError{Field: "amount", Message: "must be greater than zero"})
+	}
+	return fields
+}
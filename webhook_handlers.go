@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"sportlife/types"
+)
+
+type WebhookSubscription struct {
+	ID         int64     `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"eventTypes"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Only returned when the subscription is created
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	// Generated when empty
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             int64            `json:"id"`
+	SubscriptionID int64            `json:"subscriptionId"`
+	EventID        string           `json:"eventId"`
+	EventType      string           `json:"eventType"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  *time.Time       `json:"nextAttemptAt,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	DeliveredAt    *time.Time       `json:"deliveredAt,omitempty"`
+	Payload        json.RawMessage  `json:"payload,omitempty"`
+	AttemptLog     []WebhookAttempt `json:"attemptLog,omitempty"`
+}
+
+type WebhookAttempt struct {
+	DeliveryID   int64     `json:"-"`
+	AttemptedAt  time.Time `json:"attemptedAt"`
+	StatusCode   int       `json:"statusCode,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	ResponseBody string    `json:"responseBody,omitempty"`
+	DurationMs   int64     `json:"durationMs"`
+}
+
+const (
+	defaultWebhookDeliveryLimit = 50
+	maxWebhookDeliveryLimit     = 200
+)
+
+func handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, types.ErrCodeInvalidRequest, "Invalid request format")
+		return
+	}
+	if fields := validateWebhookSubscription(req); len(fields) > 0 {
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid webhook subscription", fields...)
+		return
+	}
+	target, _ := url.Parse(req.URL)
+	if err := checkWebhookHost(r.Context(), target.Hostname()); err != nil {
+		logFrom(r.Context()).Warn("Rejected webhook target", "url", req.URL, "error", err)
+		writeError(w, r, types.ErrCodeValidationFailed, "Invalid webhook subscription",
+			types.FieldError{Field: "url", Message: "must resolve to public addresses only"})
+		return
+	}
+	if req.Secret == "" {
+		req.Secret = "whsec_" + randomToken()
+	}
+
+	sub, err := insertWebhookSubscription(req.URL, req.Secret, req.EventTypes)
+	if err != nil {
+		logFrom(r.Context()).Error("Error inserting webhook subscription", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error saving webhook subscription")
+		return
+	}
+	sub.Secret = req.Secret
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+func validateWebhookSubscription(req WebhookSubscriptionRequest) []types.FieldError {
+	var fields []types.FieldError
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		fields = append(fields, types.FieldError{Field: "url", Message: "must be an absolute http(s) URL"})
+	}
+	if len(req.EventTypes) == 0 {
+		fields = append(fields, types.FieldError{Field: "eventTypes", Message: "is required"})
+	}
+	for _, t := range req.EventTypes {
+		if !contains(webhookEventTypes, t) {
+			fields = append(fields, types.FieldError{Field: "eventTypes", Message: "unknown event type " + t})
+		}
+	}
+	if req.Secret != "" && (len(req.Secret) < 16 || len(req.Secret) > 128) {
+		fields = append(fields, types.FieldError{Field: "secret", Message: "must be 16 to 128 characters"})
+	}
+	return fields
+}
+
+func handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	subs, err := listWebhookSubscriptions()
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing webhook subscriptions", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading webhook subscriptions")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"webhooks": subs})
+}
+
+// Deactivate a subscription. Its delivery log is kept.
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	found, err := deactivateWebhookSubscription(id)
+	if err != nil {
+		logFrom(r.Context()).Error("Error deactivating webhook subscription", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error updating webhook subscription")
+		return
+	}
+	if !found {
+		writeError(w, r, types.ErrCodeNotFound, "Webhook subscription not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	limit := defaultWebhookDeliveryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWebhookDeliveryLimit {
+			writeError(w, r, types.ErrCodeValidationFailed, "Invalid limit",
+				types.FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxWebhookDeliveryLimit)})
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := listWebhookDeliveries(id, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		logFrom(r.Context()).Error("Error listing webhook deliveries", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading webhook deliveries")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries})
+}
+
+// A single delivery with its payload and every attempt made
+func handleGetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	delivery, err := getWebhookDelivery(id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, types.ErrCodeNotFound, "Webhook delivery not found")
+		return
+	}
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading webhook delivery", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading webhook delivery")
+		return
+	}
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// Queue a delivery to be sent again right away with a fresh attempt budget
+func handleRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt64(w, r, "id")
+	if !ok {
+		return
+	}
+	found, err := resetWebhookDelivery(id)
+	if err != nil {
+		logFrom(r.Context()).Error("Error queueing webhook redelivery", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error queueing webhook redelivery")
+		return
+	}
+	if !found {
+		writeError(w, r, types.ErrCodeNotFound, "Webhook delivery not found")
+		return
+	}
+	logFrom(r.Context()).Info("Webhook redelivery requested", "delivery_id", id, "user_id", userID(r.Context()))
+
+	delivery, err := getWebhookDelivery(id)
+	if err != nil {
+		logFrom(r.Context()).Error("Error loading webhook delivery", "error", err)
+		writeError(w, r, types.ErrCodeStorageFailed, "Error loading webhook delivery")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+// Parse a numeric path parameter, replying 404 when it is not a number
+func pathInt64(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		writeError(w, r, types.ErrCodeNotFound, "Not found")
+		return 0, false
+	}
+	return id, true
+}
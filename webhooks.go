@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"sportlife/client"
+	"sportlife/types"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Event types delivered to webhook subscribers
+const (
+	eventPaymentSucceeded = "payment.succeeded"
+	eventPaymentFailed    = "payment.failed"
+	eventPaymentReversed  = "payment.reversed"
+	eventRefundCreated    = "refund.created"
+)
+
+var webhookEventTypes = []string{eventPaymentSucceeded, eventPaymentFailed, eventPaymentReversed, eventRefundCreated}
+
+// Values of webhook_deliveries.status
+const (
+	deliveryStatusPending   = "pending"
+	deliveryStatusSucceeded = "succeeded"
+	deliveryStatusFailed    = "failed"
+)
+
+const (
+	// Response bodies kept in the delivery log are cut to this many bytes
+	maxLoggedResponseBody = 1024
+	webhookClaimBatch     = 20
+)
+
+type webhookDispatcherConfig struct {
+	PollInterval time.Duration
+	Timeout      time.Duration
+	MaxAttempts  int
+	// Base of the exponential backoff between attempts
+	RetryBackoff time.Duration
+}
+
+// WEBHOOK_POLL_INTERVAL, WEBHOOK_TIMEOUT, WEBHOOK_MAX_ATTEMPTS and WEBHOOK_RETRY_BACKOFF override the defaults
+func webhookDispatcherConfigFromEnv() webhookDispatcherConfig {
+	return webhookDispatcherConfig{
+		PollInterval: envDuration("WEBHOOK_POLL_INTERVAL", 2*time.Second),
+		Timeout:      envDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		MaxAttempts:  envInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		RetryBackoff: envDuration("WEBHOOK_RETRY_BACKOFF", 30*time.Second),
+	}
+}
+
+// The JSON body of every webhook request
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// Data of payment.* events
+type PaymentEventData struct {
+	TransactionID    string         `json:"transactionId"`
+	Status           string         `json:"status"`
+	SubscriptionType string         `json:"subscriptionType"`
+	Amount           types.Money    `json:"amount"`
+	Currency         types.Currency `json:"currency"`
+	Message          string         `json:"message,omitempty"`
+}
+
+// An event waiting to be queued together with the change it reports
+type outboxEvent struct {
+	Type string
+	Data interface{}
+}
+
+// A *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Queue events for every active subscription that wants them. Called with the transaction that makes
+// the change they report, so an event is queued if and only if its change is committed. Deliveries
+// are sent by the dispatcher, so they survive restarts and are retried on failure.
+func emitEvent(ctx context.Context, q execer, events ...outboxEvent) error {
+	for _, e := range events {
+		event := WebhookEvent{ID: "evt_" + randomToken(), Type: e.Type, CreatedAt: time.Now().UTC(), Data: e.Data}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("encoding %s event: %w", e.Type, err)
+		}
+		if _, err := insertWebhookDeliveries(ctx, q, event.ID, e.Type, payload); err != nil {
+			return fmt.Errorf("queueing %s deliveries: %w", e.Type, err)
+		}
+	}
+	return nil
+}
+
+// The payment.* event reporting that a payment moved to status
+func paymentEvent(transactionID, status, subscriptionType string, amount types.Money, message string) outboxEvent {
+	eventType := eventPaymentFailed
+	switch status {
+	case paymentStatusSuccess:
+		eventType = eventPaymentSucceeded
+	case paymentStatusReversed:
+		eventType = eventPaymentReversed
+	}
+	return outboxEvent{Type: eventType, Data: PaymentEventData{
+		TransactionID:    transactionID,
+		Status:           status,
+		SubscriptionType: subscriptionType,
+		Amount:           amount,
+		Currency:         amount.Currency(),
+		Message:          message,
+	}}
+}
+
+// Prefix of secrets stored encrypted. Secrets saved before encryption was introduced have none.
+const sealedSecretPrefix = "enc:v1:"
+
+// AES-256-GCM keyed by WEBHOOK_SECRET_KEY, which encrypts subscriber secrets at rest
+func webhookSecretCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(os.Getenv("WEBHOOK_SECRET_KEY")))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a subscriber secret for storage
+func sealWebhookSecret(secret string) (string, error) {
+	aead, err := webhookSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a stored subscriber secret
+func openWebhookSecret(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedSecretPrefix)
+	if !ok {
+		return stored, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	aead, err := webhookSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed secret is too short")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting secret, was WEBHOOK_SECRET_KEY changed? %w", err)
+	}
+	return string(secret), nil
+}
+
+// Whether webhooks may be sent to ip. Loopback, private and link-local addresses would let a
+// subscriber reach services inside our network, so they are only allowed in development.
+func webhookTargetAllowed(ip net.IP) bool {
+	if developmentEnv() {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// Check every address a subscriber's host resolves to
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !webhookTargetAllowed(addr.IP) {
+			return fmt.Errorf("%s resolves to a non-public address", host)
+		}
+	}
+	return nil
+}
+
+// Checks the address actually dialed, so a host that resolves elsewhere after the subscription
+// was created, or a redirect, cannot reach an internal address
+func controlWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookTargetAllowed(ip) {
+		return fmt.Errorf("webhook target %s is not a public address", host)
+	}
+	return nil
+}
+
+// Transport for webhook requests. No proxy is used, as it would dial on our behalf.
+func webhookTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: controlWebhookDial}).DialContext
+	return otelhttp.NewTransport(transport)
+}
+
+// A due delivery together with where and how to send it
+type claimedDelivery struct {
+	ID        int64
+	EventID   string
+	EventType string
+	Payload   []byte
+	Attempts  int
+	URL       string
+	Secret    string
+}
+
+type webhookDispatcher struct {
+	cfg    webhookDispatcherConfig
+	client *http.Client
+}
+
+// Start the background loop that sends due webhook deliveries
+func startWebhookDispatcher(cfg webhookDispatcherConfig) {
+	d := &webhookDispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: webhookTransport()},
+	}
+	goBackground(func(stop context.Context) {
+		ticker := time.NewTicker(cfg.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-ticker.C:
+				d.dispatchDue(stop)
+			}
+		}
+	})
+	log.Printf("Started webhook dispatcher polling every %s", cfg.PollInterval)
+}
+
+// Claim a batch of due deliveries and send them. Claiming pushes next_attempt_at past the
+// request timeout, so other instances skip them and a crash mid-send only delays a retry.
+func (d *webhookDispatcher) dispatchDue(ctx context.Context) {
+	deliveries, err := claimDueWebhookDeliveries(webhookClaimBatch, 2*d.cfg.Timeout)
+	if err != nil {
+		logFrom(ctx).Error("Error claiming webhook deliveries", "error", err)
+		return
+	}
+	for _, delivery := range deliveries {
+		d.deliver(ctx, delivery)
+	}
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery claimedDelivery) {
+	logger := logFrom(ctx).With("delivery_id", delivery.ID, "event_id", delivery.EventID, "event_type", delivery.EventType)
+	attempt := WebhookAttempt{DeliveryID: delivery.ID, AttemptedAt: time.Now()}
+
+	// Requests already started are allowed to finish during shutdown
+	reqCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.cfg.Timeout)
+	defer cancel()
+	secret, err := openWebhookSecret(delivery.Secret)
+	var req *http.Request
+	if err == nil {
+		req, err = http.NewRequestWithContext(reqCtx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	}
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", serviceName+"-webhooks")
+		req.Header.Set(client.WebhookIDHeader, delivery.EventID)
+		req.Header.Set(client.WebhookEventHeader, delivery.EventType)
+		req.Header.Set(client.WebhookSignatureHeader, client.SignWebhook(secret, attempt.AttemptedAt, delivery.Payload))
+
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if err == nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedResponseBody))
+			resp.Body.Close()
+			attempt.StatusCode = resp.StatusCode
+			attempt.ResponseBody = string(body)
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("subscriber responded %d", resp.StatusCode)
+			}
+		}
+	}
+	attempt.DurationMs = time.Since(attempt.AttemptedAt).Milliseconds()
+
+	attempts := delivery.Attempts + 1
+	status := deliveryStatusSucceeded
+	var nextAttempt time.Time
+	if err != nil {
+		attempt.Error = err.Error()
+		status = deliveryStatusPending
+		nextAttempt = time.Now().Add(d.backoff(attempts))
+		if attempts >= d.cfg.MaxAttempts {
+			status = deliveryStatusFailed
+		}
+	}
+	webhookDeliveriesTotal.WithLabelValues(status).Inc()
+
+	if err := recordWebhookAttempt(attempt, status, attempts, nextAttempt); err != nil {
+		logger.Error("Error recording webhook attempt", "error", err)
+	}
+	switch status {
+	case deliveryStatusSucceeded:
+		logger.Info("Webhook delivered", "attempt", attempts, "status_code", attempt.StatusCode)
+	case deliveryStatusFailed:
+		logger.Error("Webhook delivery gave up", "attempt", attempts, "error", attempt.Error)
+	default:
+		logger.Warn("Webhook delivery failed, will retry", "attempt", attempts, "retry_at", nextAttempt, "error", attempt.Error)
+	}
+}
+
+// Exponential backoff: base, 2*base, 4*base, ... capped at 6 hours
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	const maxBackoff = 6 * time.Hour
+	wait := d.cfg.RetryBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const queueFullRetryAfter = 5 * time.Second
+
+const offSessionAuthenticationMessage = "Card requires authentication, which is only possible when paying in person"
+
+type workerPoolConfig struct {
+	Workers    int
+	QueueSize  int
+	JobTimeout time.Duration
+}
+
+// PAYMENT_WORKERS, PAYMENT_QUEUE_SIZE and PAYMENT_JOB_TIMEOUT override the defaults.
+// Workers also bound concurrent SMTP connections, since each sends at most one email at a time.
+func workerPoolConfigFromEnv() workerPoolConfig {
+	return workerPoolConfig{
+		Workers:    envInt("PAYMENT_WORKERS", 4),
+		QueueSize:  envInt("PAYMENT_QUEUE_SIZE", 100),
+		JobTimeout: envDuration("PAYMENT_JOB_TIMEOUT", 2*time.Minute),
+	}
+}
+
+// Everything the worker needs to finish a payment accepted by /process-payment.
+// The card number only ever lives in memory; see storedPaymentData for what outlives it.
+type paymentJob struct {
+	TransactionID    string
+	SubscriptionType string
+	Data             PaymentData
+	// Links the worker's span back to the request that accepted the payment
+	RequestSpan trace.SpanContext
+	RequestID   string
+	// Set when resuming a payment after its 3-D Secure challenge
+	AuthenticationID       string
+	AuthenticationResponse string
+}
+
+// The parts of a payment's request its row does not record, saved with it so any instance can finish
+// the payment. A card is only stored as the gateway token it was tokenized into, and only for a
+// payment that may be charged or have its card saved after its request is gone.
+type storedPaymentData struct {
+	Name       string      `json:"name"`
+	Phone      string      `json:"phone"`
+	Locale     string      `json:"locale,omitempty"`
+	OffSession bool        `json:"offSession,omitempty"`
+	SaveCard   bool        `json:"saveCard,omitempty"`
+	CardExpiry string      `json:"cardExpiry,omitempty"`
+	Card       *storedCard `json:"card,omitempty"`
+}
+
+type storedCard struct {
+	Token       string `json:"token"`
+	Brand       string `json:"brand"`
+	LastFour    string `json:"lastFour"`
+	BIN         string `json:"bin"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func storePaymentData(data PaymentData) storedPaymentData {
+	stored := storedPaymentData{
+		Name:       data.Name,
+		Phone:      data.Phone,
+		Locale:     data.Locale,
+		OffSession: data.OffSession,
+		SaveCard:   data.SaveCard,
+		CardExpiry: data.CardExpiry,
+	}
+	if c := data.TokenizedCard; c != nil {
+		stored.Card = &storedCard{Token: c.Token, Brand: c.Brand, LastFour: c.LastFour, BIN: c.BIN, Fingerprint: c.Fingerprint}
+	}
+	return stored
+}
+
+func (s storedPaymentData) apply(data *PaymentData) {
+	data.Name, data.Phone, data.Locale = s.Name, s.Phone, s.Locale
+	data.OffSession, data.SaveCard, data.CardExpiry = s.OffSession, s.SaveCard, s.CardExpiry
+	if c := s.Card; c != nil {
+		data.TokenizedCard = &PaymentMethod{Token: c.Token, Brand: c.Brand, LastFour: c.LastFour, BIN: c.BIN, Fingerprint: c.Fingerprint}
+	}
+}
+
+var (
+	paymentQueue      chan paymentJob
+	paymentJobTimeout time.Duration
+)
+
+// Start a fixed pool of payment workers fed by a bounded queue
+func startPaymentWorkers(cfg workerPoolConfig) {
+	paymentQueue = make(chan paymentJob, cfg.QueueSize)
+	paymentJobTimeout = cfg.JobTimeout
+	limitSMTPConnections(cfg.Workers)
+
+	for i := 0; i < cfg.Workers; i++ {
+		goBackground(func(stop context.Context) {
+			for {
+				select {
+				case job := <-paymentQueue:
+					runPaymentJob(job)
+				case <-stop.Done():
+					// HTTP is already drained, so finish what is queued and exit
+					for {
+						select {
+						case job := <-paymentQueue:
+							runPaymentJob(job)
+						default:
+							return
+						}
+					}
+				}
+			}
+		})
+	}
+	log.Printf("Started %d payment workers with a queue of %d", cfg.Workers, cfg.QueueSize)
+}
+
+// Queue a payment without blocking. Returns false when the queue is full.
+func enqueuePayment(job paymentJob) bool {
+	select {
+	case paymentQueue <- job:
+		paymentQueueDepth.Set(float64(len(paymentQueue)))
+		return true
+	default:
+		paymentsRejectedTotal.Inc()
+		return false
+	}
+}
+
+func runPaymentJob(job paymentJob) {
+	paymentQueueDepth.Set(float64(len(paymentQueue)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), paymentJobTimeout)
+	defer cancel()
+	processPayment(ctx, job)
+}
+
+// Charge the card, then render and email the receipt, publishing progress along the way
+func processPayment(ctx context.Context, job paymentJob) {
+	ctx, span := tracer.Start(ctx, "payment.process",
+		trace.WithLinks(trace.Link{SpanContext: job.RequestSpan}),
+		trace.WithAttributes(attribute.String("payment.transaction_id", job.TransactionID)))
+	defer span.End()
+
+	logger := logFrom(ctx).With("request_id", job.RequestID, "transaction_id", job.TransactionID)
+	ctx = withLogger(ctx, logger)
+	data := job.Data
+
+	publish := func(status, stage, message string) {
+		payments.publish(PaymentStatus{TransactionID: job.TransactionID, Status: status, Stage: stage, Message: message})
+	}
+	// Reports false when the payment had already left the from statuses, e.g. because a gateway
+	// callback or a fraud review settled it while the worker was busy
+	setStatus := func(status string, from []string, events ...outboxEvent) bool {
+		updated, err := updatePaymentStatus(ctx, job.TransactionID, status, from, events...)
+		if err != nil {
+			logger.Error("Error updating payment status", "status", status, "error", err)
+			return false
+		}
+		if !updated {
+			logger.Warn("Payment status was changed by someone else", "status", status)
+			return false
+		}
+		if err := settleCartTransaction(ctx, job.TransactionID, status); err != nil {
+			logger.Error("Error settling cart transaction", "status", status, "error", err)
+		}
+		return true
+	}
+	charging := []string{paymentStatusProcessing}
+
+	if !setStatus(paymentStatusProcessing, []string{paymentStatusPending, paymentStatusOnHold, paymentStatusAuthenticationRequired}) {
+		return
+	}
+	publish(paymentStatusProcessing, stageCharging, "")
+
+	var result chargeResult
+	err := traceStage(ctx, "payment.gateway.charge", func(ctx context.Context) (err error) {
+		if job.AuthenticationID != "" {
+			result, err = gateway.CompleteChallenge(ctx, job.AuthenticationID, job.AuthenticationResponse)
+			return err
+		}
+		req := chargeRequest{
+			TransactionID: job.TransactionID,
+			Amount:        data.Amount,
+			CardNumber:    data.CardNumber,
+			Email:         data.Email,
+			OffSession:    data.OffSession,
+			ReturnURL:     challengeReturnURL(job.TransactionID),
+		}
+		switch {
+		case data.SavedMethod != nil:
+			req.CardToken = data.SavedMethod.Token
+		case data.CardNumber == "" && data.TokenizedCard != nil:
+			req.CardToken = data.TokenizedCard.Token
+		}
+		result, err = gateway.Charge(ctx, req)
+		return err
+	})
+	if err != nil {
+		logger.Error("Error charging card", "error", err)
+		if setStatus(paymentStatusFailed, charging, paymentEvent(job.TransactionID, paymentStatusFailed, job.SubscriptionType, data.Amount, "Payment could not be processed")) {
+			recordPayment("failed", job.SubscriptionType, data.Amount)
+			publish(paymentStatusFailed, stageCompleted, "Payment could not be processed")
+		}
+		return
+	}
+	if result.Challenge != nil && data.OffSession {
+		// Nobody is there to complete the challenge, so the customer has to pay in person instead
+		logger.Warn("Issuer asked for authentication of an off-session charge")
+		if setStatus(paymentStatusFailed, charging, paymentEvent(job.TransactionID, paymentStatusFailed, job.SubscriptionType, data.Amount, offSessionAuthenticationMessage)) {
+			recordPayment("failed", job.SubscriptionType, data.Amount)
+			publish(paymentStatusFailed, stageCompleted, offSessionAuthenticationMessage)
+		}
+		return
+	}
+	if result.Challenge != nil {
+		// The worker is freed up while the cardholder authenticates; the callback queues the payment again
+		logger.Info("Cardholder authentication required")
+		parked, err := markAuthenticationRequired(ctx, job.TransactionID, result.Challenge.URL)
+		if err != nil {
+			// A challenge nobody can find the payment for would never complete
+			logger.Error("Error updating payment status", "status", paymentStatusAuthenticationRequired, "error", err)
+			if setStatus(paymentStatusFailed, charging, paymentEvent(job.TransactionID, paymentStatusFailed, job.SubscriptionType, data.Amount, "Payment could not be processed")) {
+				recordPayment("failed", job.SubscriptionType, data.Amount)
+				publish(paymentStatusFailed, stageCompleted, "Payment could not be processed")
+			}
+			return
+		}
+		if !parked {
+			logger.Warn("Payment status was changed by someone else", "status", paymentStatusAuthenticationRequired)
+			return
+		}
+		challenges.add(job, result.Challenge.AuthenticationID)
+		payments.publish(PaymentStatus{
+			TransactionID: job.TransactionID,
+			Status:        paymentStatusAuthenticationRequired,
+			Stage:         stageAuthenticating,
+			ChallengeURL:  result.Challenge.URL,
+		})
+		return
+	}
+	if !result.Approved {
+		logger.Info("Payment declined", "reason", result.DeclineReason)
+		if setStatus(paymentStatusDeclined, charging, paymentEvent(job.TransactionID, paymentStatusDeclined, job.SubscriptionType, data.Amount, result.DeclineReason)) {
+			recordPayment("declined", job.SubscriptionType, data.Amount)
+			publish(paymentStatusDeclined, stageCompleted, result.DeclineReason)
+		}
+		return
+	}
+
+	// The card is charged: from here on failures only affect the follow-ups, never the payment.
+	// A capture callback that got here first has already recorded it and completes it instead.
+	if !setStatus(paymentStatusSuccess, charging, paymentEvent(job.TransactionID, paymentStatusSuccess, job.SubscriptionType, data.Amount, "")) {
+		return
+	}
+	recordPayment("success", job.SubscriptionType, data.Amount)
+	logger.Info("Payment processed", "amount", data.Amount)
+	completePayment(ctx, job)
+}
+
+// Follow up on a payment that has just been captured: redeem its promo code, save its card if the
+// customer asked for that and send the receipt. Only whoever moved the payment to Success does
+// this, the worker or a gateway callback, so it happens once.
+func completePayment(ctx context.Context, job paymentJob) {
+	logger := logFrom(ctx)
+	data := job.Data
+	if data.Promo != nil {
+		overLimit, err := redeemPromoCode(ctx, data.Promo.Code, job.TransactionID, data.Email, data.Promo.Discount)
+		switch {
+		case err != nil:
+			logger.Error("Error redeeming promo code", "promo_code", data.Promo.Code, "error", err)
+		case overLimit:
+			promoRedemptionsOverLimitTotal.Inc()
+			logger.Warn("Promo code redeemed past its limits, marked for follow-up", "promo_code", data.Promo.Code, "discount", data.Promo.Discount)
+		}
+	}
+	if data.SaveCard && data.SavedMethod == nil && data.CustomerID != 0 {
+		if err := savePaymentCard(ctx, data); err != nil {
+			logger.Error("Error saving card", "customer_id", data.CustomerID, "error", err)
+		}
+	}
+	issueReceipt(ctx, job.TransactionID, data)
+}
+
+// Render the receipt of a successful payment, email it and record it, publishing each stage
+func issueReceipt(ctx context.Context, transactionID string, data PaymentData) {
+	logger := logFrom(ctx)
+	publish := func(status, stage, message string) {
+		payments.publish(PaymentStatus{TransactionID: transactionID, Status: status, Stage: stage, Message: message})
+	}
+
+	publish(paymentStatusSuccess, stageGeneratingReceipt, "")
+	var receiptPath string
+	err := traceStage(ctx, "payment.generate_receipt", func(ctx context.Context) (err error) {
+		receiptPath, err = generateReceipt(ctx, data)
+		return err
+	})
+	if err != nil {
+		logger.Error("Error generating receipt", "error", err)
+		publish(paymentStatusSuccess, stageCompleted, "Receipt could not be generated")
+		return
+	}
+
+	publish(paymentStatusSuccess, stageSendingEmail, "")
+	emailStatus := "Sent"
+	err = traceStage(ctx, "payment.send_email", func(ctx context.Context) error {
+		return sendEmail(ctx, data.Email, receiptPath)
+	})
+	if err != nil {
+		emailStatus = "Failed"
+	}
+
+	err = traceStage(ctx, "payment.db.insert_receipt", func(ctx context.Context) error {
+		return insertSubscriptionReceipt(ctx, transactionID, receiptPath, emailStatus)
+	})
+	if err != nil {
+		logger.Error("Error inserting subscription receipt", "error", err)
+	}
+
+	message := ""
+	if emailStatus != "Sent" {
+		message = "Receipt email could not be sent"
+	}
+	publish(paymentStatusSuccess, stageCompleted, message)
+}